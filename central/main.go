@@ -7,17 +7,30 @@ package main
  */
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/davidoram/bluetooth/hps"
 )
 
 var (
-	deviceName *string
+	deviceName   *string
+	peripheralID *string
+	serviceUUID  *string
+	minRSSI      *int
+	scanWindow   *time.Duration
+	balance      *string
+	failover     *int
+	retries      *int
+	retryBackoff *time.Duration
 
 	uri     *string
 	u       *url.URL
@@ -26,35 +39,128 @@ var (
 	method  *string
 
 	responseTimeout *time.Duration
+
+	encrypt  *bool
+	pskFile  *string
+	compress *bool
+
+	cacheDir *string
 )
 
 func init() {
 	log.SetOutput(os.Stdout)
 
 	// id = flag.String("id", hps.PeripheralID, "Peripheral ID to scan for")
-	deviceName = flag.String("name", hps.DeviceName, "Device name to scan for")
+	deviceName = flag.String("name", hps.DeviceName, "Device name to scan for, empty for any")
+	peripheralID = flag.String("peripheral", "", "ID of the peripheral to connect to, its address on Linux. eg: 'B8:27:EB:12:34:56'")
+	serviceUUID = flag.String("service", "", "Only connect to peripherals advertising this service UUID")
+	minRSSI = flag.Int("min-rssi", 0, "Only connect to peripherals with a signal of at least this many dBm, eg: -80")
+	balance = flag.String("balance", "first", "Gateway to prefer when several are found: first, rssi, round-robin or load")
+	failover = flag.Int("failover", 0, "Number of other gateways to try when a gateway fails")
+	retries = flag.Int("retries", 0, "Number of times to retry a request that failed with a transient error, a POST needs an Idempotency-Key header")
+	retryBackoff = flag.Duration("retry-backoff", hps.DefaultRetryPolicy.InitialBackoff, "Wait before the first retry, doubling for each retry after")
+	scanWindow = flag.Duration("scan-window", 0, "Scan for this long, then connect to the peripheral with the strongest signal")
 	uri = flag.String("uri", "http://localhost:8100/hello.txt", "uri")
 	flag.Var(&headers, "header", `HTTP headers. eg: -header "Accept=text/plain" -header "X-API-KEY=xyzabc"`)
 	body = flag.String("body", "", "HTTP body to POST/PUT")
 	method = flag.String("verb", "GET", "HTTP verb, eg: GET, PUT, POST, PATCH, DELETE")
 	responseTimeout = flag.Duration("timeout", time.Second*5, "Time to wait for server to return response")
+	encrypt = flag.Bool("encrypt", false, "Encrypt the request and response end-to-end")
+	pskFile = flag.String("psk", "", "File holding a pre-shared key for encrypted links, optional")
+	compress = flag.Bool("compress", true, "Negotiate compressed request & response bodies with the gateway")
+	cacheDir = flag.String("cache-dir", "", "Directory to cache GET responses in, optional")
 
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [inspect]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	if flag.Arg(0) == "inspect" {
+		inspect()
+		return
+	}
+
 	u, err := url.Parse(*uri)
 	if err != nil {
 		log.Printf("URI Parse error: %s", err)
 		return
 	}
-	c := hps.MakeClient()
-	headers := hps.ArrayStr{}
-	_, err = c.Do(u.String(), *body, *method, headers)
+	c := newClient()
+	c.Encrypt = *encrypt
+	c.DisableCompression = !*compress
+	if *pskFile != "" {
+		psk, err := ioutil.ReadFile(*pskFile)
+		if err != nil {
+			log.Printf("Error reading pre-shared key: %s", err)
+			return
+		}
+		c.PreSharedKey = bytes.TrimSpace(psk)
+	}
+	if *cacheDir != "" {
+		c.Cache, err = hps.NewDiskCache(*cacheDir)
+		if err != nil {
+			log.Printf("Error opening cache: %s", err)
+			return
+		}
+	}
+	req, err := http.NewRequest(*method, u.String(), strings.NewReader(*body))
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	req.Header = headers.Header()
+	resp, err := c.Do(req)
 	if err != nil {
 		log.Printf("Error: %s", err)
 		return
 	}
-	log.Printf("Ok")
+	resp.Body.Close()
+	log.Printf("Ok %s", resp.Status)
+}
+
+// newClient returns a client with the peripheral selection options
+func newClient() *hps.Client {
+	c := hps.MakeClient()
+	c.DeviceName = *deviceName
+	c.PeripheralID = *peripheralID
+	c.ServiceUUID = *serviceUUID
+	c.MinRSSI = *minRSSI
+	c.ScanWindow = *scanWindow
+	c.Failover = *failover
+	c.Retry = hps.DefaultRetryPolicy
+	c.Retry.MaxAttempts = *retries + 1
+	c.Retry.InitialBackoff = *retryBackoff
+	switch *balance {
+	case "first":
+		c.Balance = hps.BalanceFirst
+	case "rssi":
+		c.Balance = hps.BalanceRSSI
+	case "round-robin":
+		c.Balance = hps.BalanceRoundRobin
+	case "load":
+		c.Balance = hps.BalanceLoad
+	default:
+		log.Fatalf("Error: unknown balance '%s'", *balance)
+	}
+	return c
+}
+
+// inspect prints the peripheral's Device Information Service
+func inspect() {
+	c := newClient()
+	info, err := c.Inspect()
+	if err != nil {
+		log.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Manufacturer:      %s\n", info.Manufacturer)
+	fmt.Printf("Model:             %s\n", info.Model)
+	fmt.Printf("Serial:            %s\n", info.Serial)
+	fmt.Printf("Hardware revision: %s\n", info.HardwareRevision)
+	fmt.Printf("Firmware revision: %s\n", info.FirmwareRevision)
+	fmt.Printf("Software revision: %s\n", info.SoftwareRevision)
 }
@@ -2,4 +2,9 @@ module github.com/davidoram/bluetooth
 
 go 1.16
 
-require github.com/paypal/gatt v0.0.0-20151011220935-4ae819d591cf
+require (
+	github.com/klauspost/compress v1.15.15
+	github.com/paypal/gatt v0.0.0-20151011220935-4ae819d591cf
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	gopkg.in/yaml.v3 v3.0.1
+)
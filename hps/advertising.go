@@ -0,0 +1,47 @@
+package hps
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// CompanyID identifies the manufacturer specific data in advertisements,
+	// 0xFFFF is reserved for testing, set a Bluetooth SIG company ID in
+	// production
+	CompanyID uint16 = 0xFFFF
+
+	gatewayInfoVersion uint8 = 1
+	gatewayInfoOctets        = 8
+)
+
+var GatewayInfoError = errors.New("Invalid gateway info in manufacturer data")
+
+// GatewayInfo is advertised by the peripheral in the manufacturer specific
+// data, so that centrals can pick a gateway without connecting to it first
+type GatewayInfo struct {
+	// ID identifies the gateway, stable across restarts
+	ID uint32
+
+	// Load is the percentage of the gateway's upstream capacity in use
+	Load uint8
+}
+
+// Encode returns the manufacturer specific data, starting with the company ID
+func (g GatewayInfo) Encode(companyID uint16) []byte {
+	b := make([]byte, gatewayInfoOctets)
+	binary.LittleEndian.PutUint16(b[0:], companyID)
+	b[2] = gatewayInfoVersion
+	binary.LittleEndian.PutUint32(b[3:], g.ID)
+	b[7] = g.Load
+	return b
+}
+
+// DecodeGatewayInfo decodes the manufacturer specific data from an
+// advertisement, see gatt.Advertisement
+func DecodeGatewayInfo(b []byte, companyID uint16) (GatewayInfo, error) {
+	if len(b) < gatewayInfoOctets || binary.LittleEndian.Uint16(b) != companyID || b[2] != gatewayInfoVersion {
+		return GatewayInfo{}, GatewayInfoError
+	}
+	return GatewayInfo{ID: binary.LittleEndian.Uint32(b[3:]), Load: b[7]}, nil
+}
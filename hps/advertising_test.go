@@ -0,0 +1,30 @@
+package hps
+
+import "testing"
+
+var gatewayInfoTests = []struct {
+	b   []byte
+	g   GatewayInfo
+	err error
+}{
+	{[]byte{0xff, 0xff, 0x01, 0x78, 0x56, 0x34, 0x12, 0x32}, GatewayInfo{ID: 0x12345678, Load: 50}, nil},
+	{[]byte{0xff, 0xff, 0x01, 0x78, 0x56, 0x34, 0x12, 0x32, 0x00}, GatewayInfo{ID: 0x12345678, Load: 50}, nil},
+	{[]byte{0x4c, 0x00, 0x01, 0x78, 0x56, 0x34, 0x12, 0x32}, GatewayInfo{}, GatewayInfoError},
+	{[]byte{0xff, 0xff, 0x02, 0x78, 0x56, 0x34, 0x12, 0x32}, GatewayInfo{}, GatewayInfoError},
+	{[]byte{0xff, 0xff, 0x01}, GatewayInfo{}, GatewayInfoError},
+	{nil, GatewayInfo{}, GatewayInfoError},
+}
+
+func TestGatewayInfo(t *testing.T) {
+	for _, tt := range gatewayInfoTests {
+		g, err := DecodeGatewayInfo(tt.b, CompanyID)
+		if err != tt.err || g != tt.g {
+			t.Errorf("DecodeGatewayInfo(%x): got %+v %v, want %+v %v", tt.b, g, err, tt.g, tt.err)
+		}
+		if tt.err == nil {
+			if got, _ := DecodeGatewayInfo(g.Encode(CompanyID), CompanyID); got != g {
+				t.Errorf("round trip: got %+v, want %+v", got, g)
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package hps
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 )
 
@@ -19,3 +20,15 @@ func (i *ArrayStr) Set(value string) error {
 	*i = append(*i, value)
 	return nil
 }
+
+// Header returns the 'key=value' pairs as HTTP headers
+func (i ArrayStr) Header() http.Header {
+	h := http.Header{}
+	for _, kv := range i {
+		values := strings.SplitN(kv, "=", 2)
+		if len(values) == 2 {
+			h.Add(values[0], values[1])
+		}
+	}
+	return h
+}
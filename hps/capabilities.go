@@ -0,0 +1,89 @@
+package hps
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// The capabilities characteristic advertises the extensions to the HPS spec
+// a peripheral supports. Its value is read in plain text, before any
+// handshake:
+//
+//	version (1 octet) || features (uint32, little endian)
+//
+// Later versions may append octets, which are ignored. A peripheral without
+// it is plain HPS, and the client uses none of the extensions.
+
+// ProtocolVersion is bumped for changes older clients can't use, features
+// that can be ignored only add a bit
+const ProtocolVersion uint8 = 1
+
+// Feature is a set of extensions to the HPS spec
+type Feature uint32
+
+const (
+	// FeatureEncryption is the key exchange, see KeyExchangeID
+	FeatureEncryption Feature = 1 << iota
+	// FeatureBodySegments streams long bodies, see BodySegmentID
+	FeatureBodySegments
+	// FeatureGzip & FeatureDeflate compress bodies, see Encodings
+	FeatureGzip
+	FeatureDeflate
+	// FeatureCompactHeaders is the compact header encoding, see
+	// EncodeCompactHeaders
+	FeatureCompactHeaders
+	// FeatureZstd compresses bodies with zstd, see Encodings
+	FeatureZstd
+)
+
+var CapabilitiesError = errors.New("Invalid capabilities")
+
+// Capabilities is the value of the capabilities characteristic
+type Capabilities struct {
+	Version  uint8
+	Features Feature
+}
+
+// Has reports whether every feature in f is supported
+func (c Capabilities) Has(f Feature) bool {
+	return c.Features&f == f
+}
+
+func (c Capabilities) Encode() []byte {
+	b := make([]byte, 5)
+	b[0] = c.Version
+	binary.LittleEndian.PutUint32(b[1:], uint32(c.Features))
+	return b
+}
+
+func DecodeCapabilities(b []byte) (Capabilities, error) {
+	if len(b) < 5 || b[0] == 0 {
+		return Capabilities{}, CapabilitiesError
+	}
+	return Capabilities{Version: b[0], Features: Feature(binary.LittleEndian.Uint32(b[1:5]))}, nil
+}
+
+// negotiate returns the features wanted that the peripheral supports, none
+// if it has a protocol version the client doesn't
+func negotiate(c Capabilities, want Feature) Feature {
+	if c.Version != ProtocolVersion {
+		return 0
+	}
+	return c.Features & want
+}
+
+// bodyEncodings lists the body encodings in f, in order of preference
+func bodyEncodings(f Feature) string {
+	var es []string
+	if f&FeatureZstd != 0 {
+		es = append(es, "zstd")
+	}
+	if f&FeatureGzip != 0 {
+		es = append(es, "gzip")
+	}
+	if f&FeatureDeflate != 0 {
+		es = append(es, "deflate")
+	}
+	return strings.Join(es, ", ")
+}
@@ -0,0 +1,54 @@
+package hps
+
+import "testing"
+
+func TestCapabilities(t *testing.T) {
+	c := Capabilities{Version: ProtocolVersion, Features: FeatureBodySegments | FeatureGzip}
+	got, err := DecodeCapabilities(c.Encode())
+	if err != nil || got != c {
+		t.Errorf("got %+v, err: %v", got, err)
+	}
+	if !got.Has(FeatureGzip) || got.Has(FeatureGzip|FeatureDeflate) {
+		t.Errorf("Has: got %+v", got)
+	}
+
+	// Octets appended by later versions are ignored
+	if got, err := DecodeCapabilities(append(c.Encode(), 0xff)); err != nil || got != c {
+		t.Errorf("appended: got %+v, err: %v", got, err)
+	}
+	for _, b := range [][]byte{nil, {1, 0, 0}, {0, 1, 0, 0, 0}} {
+		if _, err := DecodeCapabilities(b); err != CapabilitiesError {
+			t.Errorf("%v: got %v", b, err)
+		}
+	}
+}
+
+var negotiateFeatureTests = []struct {
+	c    Capabilities
+	want Feature
+	got  Feature
+}{
+	{Capabilities{ProtocolVersion, FeatureBodySegments | FeatureGzip}, FeatureGzip | FeatureDeflate, FeatureGzip},
+	{Capabilities{ProtocolVersion, FeatureBodySegments}, 0, 0},
+	{Capabilities{ProtocolVersion + 1, FeatureBodySegments}, FeatureBodySegments, 0},
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tt := range negotiateFeatureTests {
+		if got := negotiate(tt.c, tt.want); got != tt.got {
+			t.Errorf("negotiate(%+v, %#x): got %#x, want %#x", tt.c, tt.want, got, tt.got)
+		}
+	}
+}
+
+func TestBodyEncodings(t *testing.T) {
+	if got := bodyEncodings(FeatureGzip | FeatureDeflate | FeatureCompactHeaders); got != "gzip, deflate" {
+		t.Errorf("got %q", got)
+	}
+	if got := bodyEncodings(FeatureZstd | FeatureGzip | FeatureDeflate); got != "zstd, gzip, deflate" {
+		t.Errorf("got %q", got)
+	}
+	if got := bodyEncodings(FeatureBodySegments); got != "" {
+		t.Errorf("got %q", got)
+	}
+}
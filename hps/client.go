@@ -4,10 +4,11 @@ package hps
 import (
 	"context"
 	"errors"
-	"fmt"
 	"log"
+	"net/http"
 	"net/url"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/paypal/gatt"
@@ -20,184 +21,670 @@ var (
 	DisconnectedError      = errors.New("Disconnected")
 )
 
+// Client makes HTTP requests through an HPS gateway. It is safe for use by
+// several goroutines, their requests take turns on the adapter, waiting
+// until their context ends. Set the options before the first request.
 type Client struct {
 	DebugLog        bool
-	DeviceName      string
 	ConnectTimeout  time.Duration
 	ResponseTimeout time.Duration
 
-	uri     string
+	// Peripheral selection, a peripheral must match every option that is
+	// set. PeripheralID is the ID reported by gatt, the address on Linux.
+	// ServiceUUID must be in the advertisement, it defaults to scanning for
+	// the HPS service without requiring it.
+	DeviceName   string
+	PeripheralID string
+	ServiceUUID  string
+	MinRSSI      int
+
+	// ScanWindow, if set, scans for this long then connects to the matching
+	// peripheral with the strongest signal, rather than the first found
+	ScanWindow time.Duration
+
+	// Balance orders the gateways found while scanning. Failover is how
+	// many other gateways to try after a connection timeout, a disconnect,
+	// or a 502 or 503 status, see Idempotent for the requests that fail
+	// over once sent. Failed gateways are skipped, backing off
+	// exponentially.
+	Balance  Balance
+	Failover int
+
+	// Retry retries a request that failed with a transient error, after
+	// failing over. Each retry starts over with every gateway, including
+	// those backing off.
+	Retry RetryPolicy
+
+	// Encrypt turns on end-to-end encryption of the characteristic values,
+	// PreSharedKey is optional, and must match the peripheral's if set
+	Encrypt      bool
+	PreSharedKey []byte
+
+	// Cache is optional, if set fresh GET responses are served from it
+	// without connecting to the peripheral
+	Cache CacheStore
+
+	// DisableCompression stops Do from negotiating compressed bodies &
+	// headers over the BLE link, see Encodings & EncodeCompactHeaders
+	DisableCompression bool
+
+	// mu guards the gateway health & the queue, shared between requests
+	mu          sync.Mutex
+	health      map[string]*gatewayHealth
+	lastGateway string
+
+	// busy is set while a request has the adapter. The others wait their
+	// turn in queue, in order, each woken by closing its channel.
+	busy  bool
+	queue []chan struct{}
+}
+
+// hpsRequest is a request to make over BLE, or an inspection
+type hpsRequest struct {
+	ctx     context.Context
 	u       *url.URL
 	headers ArrayStr
 	body    string
 	method  string
 
-	responseChannel chan bool
-	response        *Response
-	lastError       error
+	// inspecting is set by Inspect, which reads info rather than making a
+	// request
+	inspecting bool
+
+	// stream is set to stream long bodies, and compress is set to
+	// negotiate compressed bodies, see Client.Do
+	stream   bool
+	compress bool
+}
+
+// transaction is one run of a request, connecting to a single gateway.
+// Failover & retries start a new transaction. The gatt handlers run on
+// gatt's goroutines, mu guards the state they share.
+type transaction struct {
+	client *Client
+	req    *hpsRequest
 
+	// tried is shared by the transactions for a request, so failover skips
+	// the gateways tried already. Gateways in backoff are skipped, unless
+	// retrying.
+	tried    map[string]bool
+	retrying bool
+
+	mu          sync.Mutex
 	foundServer bool
-	hpsService  *gatt.Service
+	gatewayID   string
+	response    *Response
+
+	// sent is set once the control point is written, the gateway may have
+	// made the upstream call from then on
+	sent bool
+
+	// lastError is the first error of the run, see fail
+	lastError error
+
+	scanFor []gatt.UUID
+	found   candidates
+
+	responseChannel chan bool
+	done            chan bool
 
-	uriChr, hdrsChr, bodyChr, controlChr, statusChr *gatt.Characteristic
+	hpsService *gatt.Service
+	session    *Session
+	info       DeviceInfo
 
-	done chan bool
+	// features are the extensions used with the peripheral, see
+	// negotiateFeatures
+	features Feature
+
+	// stream is set once the body is streamed, it then owns the connection
+	stream         *bodyStream
+	disconnected   chan struct{}
+	disconnectOnce sync.Once
+
+	uriChr, hdrsChr, bodyChr, controlChr, statusChr, kexChr, segmentChr, capsChr *gatt.Characteristic
 }
 
 func MakeClient() *Client {
 
 	c := Client{
-		DeviceName:      DeviceName,
-		lastError:       UnknownError,
-		responseChannel: make(chan bool, 1),
-		done:            make(chan bool, 1),
-		response:        &Response{},
+		DeviceName: DeviceName,
 	}
 	c.ConnectTimeout, _ = time.ParseDuration("5s")
 	c.ResponseTimeout, _ = time.ParseDuration("5s")
 	return &c
 }
 
-func (client *Client) Do(uri, body, method string, headers ArrayStr) (Response, error) {
-	client.uri = uri
-	client.u, client.lastError = url.Parse(client.uri)
-	if client.lastError != nil {
-		log.Printf("Error Parsing URI, err: %v", client.lastError)
-		return *client.response, client.lastError
+// DoRaw makes a request with the values for the HPS characteristics, and
+// returns the raw response. Prefer Do.
+func (client *Client) DoRaw(uri, body, method string, headers ArrayStr) (Response, error) {
+	return client.send(context.Background(), uri, body, method, headers, false)
+}
+
+// send makes the request, serving GETs from the cache where possible
+func (client *Client) send(ctx context.Context, uri, body, method string, headers ArrayStr, stream bool) (Response, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		log.Printf("Error Parsing URI, err: %v", err)
+		return Response{}, err
+	}
+	if client.Cache == nil || method != http.MethodGet {
+		return client.do(ctx, uri, body, method, headers, stream)
+	}
+
+	key := CacheKey(method, u.String())
+	reqHeader := headers.Header()
+	cached, ok := client.Cache.Get(key)
+	if ok && !cached.Matches(reqHeader) {
+		ok = false
+	}
+	if ok && cached.Fresh(reqHeader, time.Now(), false) {
+		log.Printf("cache hit %s", key)
+		return cachedResponse(cached), nil
+	}
+	if ok {
+		// Ask the peripheral to reply 304 Not Modified if our copy is current
+		conditional := http.Header{}
+		cached.Revalidate(conditional)
+		headers = append(ArrayStr{}, headers...)
+		for name := range conditional {
+			headers = append(headers, name+"="+conditional.Get(name))
+		}
+	}
+
+	r, err := client.do(ctx, uri, body, method, headers, stream)
+	if err != nil {
+		return r, err
+	}
+	respHeader := r.DecodedHeaders()
+	if ok && r.NotifyStatus.StatusCode == http.StatusNotModified {
+		log.Printf("cache revalidated %s", key)
+		r.closeBody()
+		refreshed := cached.Refresh(respHeader, time.Now())
+		client.Cache.Set(key, refreshed)
+		return cachedResponse(refreshed), nil
+	}
+	if !r.NotifyStatus.HeadersTruncated && !r.NotifyStatus.BodyTruncated && r.stream == nil &&
+		Cacheable(method, reqHeader, r.NotifyStatus.StatusCode, respHeader, false) {
+		client.Cache.Set(key, NewCachedResponse(reqHeader, r.NotifyStatus.StatusCode, respHeader, r.Body, time.Now()))
+	}
+	return r, nil
+}
+
+// cachedResponse builds a Response from the cache
+func cachedResponse(c *CachedResponse) Response {
+	h := c.Header.Clone()
+	h.Set("Age", strconv.Itoa(int(c.Age(time.Now()).Seconds())))
+	b, trunc := EncodeHeaders(h)
+	return Response{
+		NotifyStatus: NotifyStatus{
+			StatusCode:       c.StatusCode,
+			HeadersReceived:  true,
+			HeadersTruncated: trunc,
+			BodyReceived:     len(c.Body) > 0,
+		},
+		Headers:   b,
+		Body:      c.Body,
+		FromCache: true,
+	}
+}
+
+// do makes the request over BLE, once it's the request's turn
+func (client *Client) do(ctx context.Context, uri, body, method string, headers ArrayStr, stream bool) (r Response, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		log.Printf("Error Parsing URI, err: %v", err)
+		return Response{}, err
+	}
+	// DoRaw returns the values as read, only Do streams & decompresses
+	req := &hpsRequest{ctx: ctx, u: u, method: method, body: body, headers: headers,
+		stream: stream, compress: stream && !client.DisableCompression}
+	if err := client.acquire(ctx); err != nil {
+		return Response{}, err
+	}
+	defer func() {
+		// A streamed body keeps the adapter until it is closed
+		if r.stream != nil {
+			r.stream.release = client.release
+		} else {
+			client.release()
+		}
+	}()
+
+	h := headers.Header()
+	for attempt := 0; ; attempt++ {
+		r, err = client.tryGateways(req, attempt > 0)
+		if !client.Retry.retry(attempt, method, h, r, err) {
+			return r, err
+		}
+		r.closeBody()
+		wait := client.Retry.backoff(attempt, jitterFloat64)
+		log.Printf("Warn: request failed, retrying in %v, err: %v, status: %d", wait, err, r.NotifyStatus.StatusCode)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return r, ctx.Err()
+		}
 	}
-	client.method = method
-	client.body = body
-	client.headers = headers
+}
 
-	var d gatt.Device
-	d, client.lastError = gatt.NewDevice(option.DefaultClientOptions...)
-	if client.lastError != nil {
-		return *client.response, client.lastError
+// acquire waits for the request's turn on the adapter, or for the context to
+// end. Waiting requests take turns in order.
+func (client *Client) acquire(ctx context.Context) error {
+	client.mu.Lock()
+	if !client.busy {
+		client.busy = true
+		client.mu.Unlock()
+		return nil
+	}
+	turn := make(chan struct{})
+	client.queue = append(client.queue, turn)
+	client.mu.Unlock()
+
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
 	}
+	client.mu.Lock()
+	for i, t := range client.queue {
+		if t == turn {
+			client.queue = append(client.queue[:i], client.queue[i+1:]...)
+			client.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	client.mu.Unlock()
+	// The turn came as the context ended, pass it on
+	client.release()
+	return ctx.Err()
+}
+
+// release ends the request's turn on the adapter, starting the next
+func (client *Client) release() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.queue) == 0 {
+		client.busy = false
+		return
+	}
+	next := client.queue[0]
+	client.queue = client.queue[1:]
+	close(next)
+}
+
+// tryGateways makes the request, failing over to other gateways
+func (client *Client) tryGateways(req *hpsRequest, retrying bool) (Response, error) {
+	tried := map[string]bool{}
+	for attempt := 0; ; attempt++ {
+		tx := client.newTransaction(req, tried, retrying)
+		err := tx.run()
+		r, gatewayID := tx.result()
+		if err == nil {
+			err = upstreamError(r)
+		}
+		if gatewayID == "" {
+			// Never connected
+			return r, err
+		}
+		retry := failover(r, err)
+		client.recordHealth(gatewayID, !retry, time.Now())
+		if !retry || attempt >= client.Failover || req.ctx.Err() != nil {
+			return r, err
+		}
+		if !resend(req.method, req.headers.Header(), tx.requestSent()) {
+			log.Printf("Warn: gateway peripheral_id: %s failed, not failing over a request that isn't idempotent, err: %v, status: %d", gatewayID, err, r.NotifyStatus.StatusCode)
+			return r, err
+		}
+		r.closeBody()
+		log.Printf("Warn: gateway peripheral_id: %s failed, trying the next, err: %v, status: %d", gatewayID, err, r.NotifyStatus.StatusCode)
+	}
+}
+
+// Inspect connects to the peripheral and reads its Device Information
+// Service
+func (client *Client) Inspect() (DeviceInfo, error) {
+	return client.InspectContext(context.Background())
+}
+
+// InspectContext is Inspect, the context cancels it
+func (client *Client) InspectContext(ctx context.Context) (DeviceInfo, error) {
+	if err := client.acquire(ctx); err != nil {
+		return DeviceInfo{}, err
+	}
+	defer client.release()
+	tx := client.newTransaction(&hpsRequest{ctx: ctx, inspecting: true}, map[string]bool{}, false)
+	err := tx.run()
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.info, err
+}
+
+func (client *Client) newTransaction(req *hpsRequest, tried map[string]bool, retrying bool) *transaction {
+	return &transaction{
+		client:          client,
+		req:             req,
+		tried:           tried,
+		retrying:        retrying,
+		response:        &Response{},
+		responseChannel: make(chan bool, 1),
+		done:            make(chan bool, 1),
+		disconnected:    make(chan struct{}),
+	}
+}
+
+// result returns the response, and the gateway it came from
+func (tx *transaction) result() (Response, string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	r := *tx.response
+	r.stream = tx.stream
+	return r, tx.gatewayID
+}
+
+// requestSent reports whether the control point was written
+func (tx *transaction) requestSent() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.sent
+}
+
+// run connects to the peripheral and waits until the request is done
+func (tx *transaction) run() error {
+	var err error
+	tx.scanFor, err = tx.client.scanFilter()
+	if err != nil {
+		return &ScanError{Err: err}
+	}
+
+	d, err := gatt.NewDevice(option.DefaultClientOptions...)
+	if err != nil {
+		return &ScanError{Err: err}
+	}
+	// Release the adapter, so the next request or failover attempt can use
+	// it. A streamed body releases it once closed.
+	defer func() {
+		tx.mu.Lock()
+		stream := tx.stream
+		if stream != nil && tx.lastError != nil {
+			tx.stream = nil
+			stream.Close()
+		}
+		tx.mu.Unlock()
+		if stream == nil {
+			stopDevice(d)
+		}
+	}()
 
 	// Register handlers.
 	d.Handle(
-		gatt.PeripheralDiscovered(client.onPeriphDiscovered),
-		gatt.PeripheralConnected(client.onPeriphConnected),
-		gatt.PeripheralDisconnected(client.onPeriphDisconnected),
+		gatt.PeripheralDiscovered(tx.onPeriphDiscovered),
+		gatt.PeripheralConnected(tx.onPeriphConnected),
+		gatt.PeripheralDisconnected(tx.onPeriphDisconnected),
 	)
 
-	d.Init(client.onStateChanged)
-	done := <-client.done
-	if !done && client.lastError == nil {
-		client.lastError = DisconnectedError
+	d.Init(tx.onStateChanged)
+	select {
+	case done := <-tx.done:
+		if !done {
+			tx.mu.Lock()
+			id := tx.gatewayID
+			tx.mu.Unlock()
+			tx.fail(&ConnectError{PeripheralID: id, Err: DisconnectedError})
+		}
+	case <-tx.req.ctx.Done():
+		tx.fail(tx.req.ctx.Err())
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.lastError
+}
+
+// fail records the error that ended the run. The handlers run on gatt's
+// goroutines, and one failure often causes others, eg: a disconnect, so
+// only the first counts.
+func (tx *transaction) fail(err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.lastError == nil {
+		tx.lastError = err
 	}
-	return *client.response, client.lastError
 }
 
-func (client *Client) onStateChanged(d gatt.Device, s gatt.State) {
+// finish ends the run, ok is false if the peripheral disconnected or could
+// not be found. Only the first call counts.
+func (tx *transaction) finish(ok bool) {
+	select {
+	case tx.done <- ok:
+	default:
+	}
+}
+
+func (tx *transaction) onStateChanged(d gatt.Device, s gatt.State) {
 	log.Printf("state changed to %s", s.String())
 	switch s {
 	case gatt.StatePoweredOn:
-		go client.scanPeriodically(d)
+		go tx.scanPeriodically(d)
 	default:
 		d.StopScanning()
 	}
 }
 
-func (client *Client) scanPeriodically(d gatt.Device) {
+func (tx *transaction) scanPeriodically(d gatt.Device) {
 	log.Printf("start periodic scan")
 
-	// Create a new context
-	ctx := context.Background()
 	// Create a new context, with its cancellation function
-	// from the original context
-	ctx, _ = context.WithTimeout(ctx, client.ConnectTimeout)
+	// from the request's context
+	ctx, cancel := context.WithTimeout(tx.req.ctx, tx.client.ConnectTimeout)
+	defer cancel()
+
+	var window <-chan time.Time
+	if w := tx.client.balanceWindow(); w > 0 {
+		window = time.After(w)
+	}
 
 	timeout := false
-	for !client.foundServer && !timeout {
+	for !tx.connecting() && !timeout {
 		select {
 		case <-ctx.Done():
 			log.Printf("Connection timeout")
 			timeout = true
-			client.lastError = ConnectionTimeoutError
-			client.done <- false
+			if err := tx.req.ctx.Err(); err != nil {
+				tx.fail(err)
+			} else {
+				tx.fail(&ScanError{Err: ConnectionTimeoutError})
+			}
+			tx.finish(false)
+		case <-window:
+			// Connect to the best gateway seen, or keep scanning for the
+			// first match
+			window = nil
+			if p, ok := tx.found.close(tx.choose); ok {
+				tx.connect(p)
+			}
 		default:
-			d.Scan([]gatt.UUID{}, false)
+			d.Scan(tx.scanFor, false)
 			time.Sleep(time.Millisecond * 100)
 		}
 	}
 	log.Printf("stop periodic scan")
 }
 
-func (client *Client) onPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
-	if p.Name() != client.DeviceName {
-		log.Printf("Skip peripheral_id: %s, name: %s", p.ID(), p.Name())
+// connecting reports whether a gateway has been picked
+func (tx *transaction) connecting() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.foundServer
+}
+
+func (tx *transaction) onPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+	if !tx.client.matches(tx.scanFor, p.ID(), p.Name(), a, rssi) {
+		log.Printf("Skip peripheral_id: %s, name: %s, rssi: %d", p.ID(), p.Name(), rssi)
 		return
 	}
-	client.foundServer = true
+	if !tx.eligible(p.ID(), time.Now()) {
+		log.Printf("Skip peripheral_id: %s, tried already or backing off", p.ID())
+		return
+	}
+	if tx.client.balanceWindow() > 0 {
+		log.Printf("Candidate peripheral_id: %s, rssi: %d", p.ID(), rssi)
+		// Connect straight away if the window closed with no candidates
+		if closed := tx.found.add(p, a, rssi); !closed {
+			return
+		}
+	}
+	tx.connect(p)
+}
+
+// eligible reports whether the gateway can be used, it must not have been
+// tried already for this request, or be in backoff unless retrying
+func (tx *transaction) eligible(id string, now time.Time) bool {
+	tx.mu.Lock()
+	tried := tx.tried[id]
+	tx.mu.Unlock()
+	return !tried && (tx.retrying || tx.client.healthy(id, now))
+}
+
+// choose picks the gateway to connect to from the candidates, following
+// Balance
+func (tx *transaction) choose(cs []candidate) (candidate, bool) {
+	now := time.Now()
+	var eligible []candidate
+	for _, c := range cs {
+		if tx.eligible(c.p.ID(), now) {
+			eligible = append(eligible, c)
+		}
+	}
+	b := tx.client.Balance
+	if b == BalanceFirst {
+		b = BalanceRSSI
+	}
+	tx.client.mu.Lock()
+	last := tx.client.lastGateway
+	tx.client.mu.Unlock()
+	return choose(eligible, b, last)
+}
+
+// connect stops scanning, and connects to the selected peripheral
+func (tx *transaction) connect(p gatt.Peripheral) {
+	tx.mu.Lock()
+	if tx.foundServer {
+		tx.mu.Unlock()
+		return
+	}
+	tx.foundServer = true
+	tx.gatewayID = p.ID()
+	tx.tried[p.ID()] = true
+	tx.mu.Unlock()
+
+	tx.client.mu.Lock()
+	tx.client.lastGateway = p.ID()
+	tx.client.mu.Unlock()
 
 	// Stop scanning once we've got the peripheral we're looking for.
-	log.Printf("Found HPS server")
+	log.Printf("Found HPS server, connecting to peripheral_id: %s", p.ID())
 	p.Device().StopScanning()
 	p.Device().Connect(p)
 }
 
-func (client *Client) onPeriphConnected(p gatt.Peripheral, err error) {
+func (tx *transaction) onPeriphConnected(p gatt.Peripheral, err error) {
 	log.Printf("connected")
-
-	if client.lastError = p.SetMTU(500); client.lastError != nil {
-		log.Printf("Error setting MTU, err: %v", client.lastError)
+	if err != nil {
+		log.Printf("Error connecting, err: %v", err)
+		tx.fail(&ConnectError{PeripheralID: p.ID(), Err: err})
+		tx.finish(false)
 		return
 	}
+	if err := tx.request(p); err != nil {
+		log.Printf("Error: %v", err)
+		tx.fail(err)
+	}
+	tx.mu.Lock()
+	streaming := tx.stream != nil
+	tx.mu.Unlock()
+	if !streaming {
+		p.Device().CancelConnection(p)
+	}
+}
+
+// request makes the request, or reads the device information when
+// inspecting, once connected
+func (tx *transaction) request(p gatt.Peripheral) error {
+	if err := p.SetMTU(500); err != nil {
+		return &ConnectError{PeripheralID: p.ID(), Err: attError("exchange MTU", nil, err)}
+	}
 
 	// Discovery services
-	var ss []*gatt.Service
-	ss, client.lastError = p.DiscoverServices(nil)
-	if client.lastError != nil {
-		log.Printf("Error Discover services, err: %v", client.lastError)
-		return
+	ss, err := p.DiscoverServices(nil)
+	if err != nil {
+		return &DiscoveryError{PeripheralID: p.ID(), Err: err}
+	}
+
+	if tx.req.inspecting {
+		info, err := readDeviceInfo(p, ss)
+		if err != nil {
+			return err
+		}
+		tx.mu.Lock()
+		tx.info = info
+		tx.mu.Unlock()
+		tx.finish(true)
+		return nil
 	}
 
 	for _, s := range ss {
-		if s.UUID().Equal(gatt.MustParseUUID(HpsServiceID)) {
-			client.hpsService = s
-			err := client.parseService(p)
-			if err != nil {
-				log.Printf("Warning Parsing service, err: %v", err)
-				continue
-			}
-			client.lastError = client.callService(p)
-			if client.lastError != nil {
-				log.Printf("Error Calling service, err: %v", client.lastError)
+		if !s.UUID().Equal(gatt.MustParseUUID(HpsServiceID)) {
+			continue
+		}
+		tx.hpsService = s
+		if err := tx.parseService(p); err != nil {
+			return err
+		}
+		if err := tx.negotiateFeatures(p); err != nil {
+			return err
+		}
+		if tx.client.Encrypt {
+			if err := tx.handshake(p); err != nil {
+				return err
 			}
-			break
 		}
+		return tx.callService(p)
 	}
+	return &DiscoveryError{PeripheralID: p.ID(), UUID: HpsServiceID, Err: ServiceMissingError}
 }
 
-func (client *Client) onPeriphDisconnected(p gatt.Peripheral, err error) {
+func (tx *transaction) onPeriphDisconnected(p gatt.Peripheral, err error) {
 	log.Printf("disconnected")
-	client.done <- false
+	tx.disconnectOnce.Do(func() { close(tx.disconnected) })
+	tx.finish(false)
 }
 
-func (client *Client) parseService(p gatt.Peripheral) error {
+func (tx *transaction) parseService(p gatt.Peripheral) error {
 	log.Printf("parse service")
 
 	// Discovery characteristics
-	var cs []*gatt.Characteristic
-	cs, client.lastError = p.DiscoverCharacteristics(nil, client.hpsService)
-	if client.lastError != nil {
-		return client.lastError
+	cs, err := p.DiscoverCharacteristics(nil, tx.hpsService)
+	if err != nil {
+		return &DiscoveryError{PeripheralID: p.ID(), UUID: HpsServiceID, Err: err}
 	}
 	for _, c := range cs {
 		// log.Printf("discovered characteristic name: %s", c.Name())
 		switch c.UUID().String() {
 		case gatt.UUID16(HTTPURIID).String():
-			client.uriChr = c
+			tx.uriChr = c
 		case gatt.UUID16(HTTPHeadersID).String():
-			client.hdrsChr = c
+			tx.hdrsChr = c
 		case gatt.UUID16(HTTPEntityBodyID).String():
-			client.bodyChr = c
+			tx.bodyChr = c
 		case gatt.UUID16(HTTPControlPointID).String():
-			client.controlChr = c
+			tx.controlChr = c
 		case gatt.UUID16(HTTPStatusCodeID).String():
-			client.statusChr = c
+			tx.statusChr = c
+		case gatt.MustParseUUID(KeyExchangeID).String():
+			tx.kexChr = c
+		case gatt.MustParseUUID(BodySegmentID).String():
+			tx.segmentChr = c
+		case gatt.MustParseUUID(CapabilitiesID).String():
+			tx.capsChr = c
 		}
 
 		// Discovery descriptors
@@ -220,10 +707,11 @@ func (client *Client) parseService(p gatt.Peripheral) error {
 		if (c.Properties() & (gatt.CharNotify | gatt.CharIndicate)) != 0 {
 			f := func(c *gatt.Characteristic, b []byte, err error) {
 				if c.UUID().Equal(gatt.UUID16(HTTPStatusCodeID)) {
-					var ns NotifyStatus
-					ns, client.lastError = DecodeNotifyStatus(b)
-					if client.lastError != nil {
-						log.Printf("Error decoding notify status err: %v", client.lastError)
+					ns, err := tx.notifyStatus(c, b, err)
+					if err != nil {
+						log.Printf("Error notify status err: %v", err)
+						tx.fail(err)
+						tx.notify(false)
 						return
 					}
 					log.Printf("got headers?       %t", ns.HeadersReceived)
@@ -231,83 +719,256 @@ func (client *Client) parseService(p gatt.Peripheral) error {
 					log.Printf("body received?     %t", ns.BodyReceived)
 					log.Printf("body truncated?    %t", ns.BodyTruncated)
 					log.Printf("status:  %d", ns.StatusCode)
-					client.response = &Response{NotifyStatus: ns}
-					client.responseChannel <- true
+					tx.mu.Lock()
+					tx.response = &Response{NotifyStatus: ns}
+					tx.mu.Unlock()
+					tx.notify(true)
 				}
 			}
-			if client.lastError = p.SetNotifyValue(c, f); client.lastError != nil {
-				log.Printf("Error subscribing to notifications, err: %v", client.lastError)
-				continue
+			if err := p.SetNotifyValue(c, f); err != nil {
+				return attError("subscribe", c, err)
 			}
 		}
 
 	}
+
+	required := []struct {
+		c  *gatt.Characteristic
+		id uint16
+	}{
+		{tx.uriChr, HTTPURIID},
+		{tx.hdrsChr, HTTPHeadersID},
+		{tx.bodyChr, HTTPEntityBodyID},
+		{tx.controlChr, HTTPControlPointID},
+		{tx.statusChr, HTTPStatusCodeID},
+	}
+	for _, r := range required {
+		if r.c == nil {
+			return &DiscoveryError{PeripheralID: p.ID(), UUID: gatt.UUID16(r.id).String(), Err: CharacteristicMissingError}
+		}
+	}
 	return nil
 }
 
-func (client *Client) callService(p gatt.Peripheral) error {
-	defer p.Device().CancelConnection(p)
+// notifyStatus decodes a notification from the status code characteristic
+func (tx *transaction) notifyStatus(c *gatt.Characteristic, b []byte, err error) (NotifyStatus, error) {
+	if err != nil {
+		return NotifyStatus{}, attError("notify", c, err)
+	}
+	if b, err = tx.open(c, b); err != nil {
+		return NotifyStatus{}, err
+	}
+	return DecodeNotifyStatus(b)
+}
+
+// notify passes the outcome of the request to callService, ok is false if
+// the status couldn't be decoded
+func (tx *transaction) notify(ok bool) {
+	select {
+	case tx.responseChannel <- ok:
+	default:
+	}
+}
+
+// requestURI returns the value for the URI characteristic, and the scheme for
+// the control point. Logical URIs such as '/telemetry' or
+// 'svc://config/flags' are written whole, for the peripheral's route table.
+func requestURI(u *url.URL) (string, string) {
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host + u.EscapedPath(), u.Scheme
+	default:
+		return u.String(), "http"
+	}
+}
 
+func (tx *transaction) callService(p gatt.Peripheral) error {
 	log.Printf("call service")
 
-	urlStr := fmt.Sprintf("%s%s", client.u.Host, client.u.EscapedPath())
-	log.Printf("write method + uri: %s %s", client.method, client.u.String())
-	client.lastError = p.WriteCharacteristic(client.uriChr, []byte(urlStr), true)
-	if client.lastError != nil {
-		return client.lastError
+	req := tx.req
+	urlStr, scheme := requestURI(req.u)
+	log.Printf("write method + uri: %s %s", req.method, req.u.String())
+	if err := tx.writeCharacteristic(p, tx.uriChr, []byte(urlStr), true); err != nil {
+		return err
 	}
 
-	log.Printf("write headers: %v", client.headers)
-	client.lastError = p.WriteCharacteristic(client.hdrsChr, []byte(client.headers.String()), true)
-	if client.lastError != nil {
-		return client.lastError
+	hb, _, body, err := encodeLinkRequest(req.headers, []byte(req.body), tx.features)
+	if err != nil {
+		return err
 	}
 
-	log.Printf("write body: %s", client.body)
-	client.lastError = p.WriteCharacteristic(client.bodyChr, []byte(client.body), true)
-	if client.lastError != nil {
-		return client.lastError
+	log.Printf("write headers: %d octets", len(hb))
+	if err := tx.writeCharacteristic(p, tx.hdrsChr, hb, true); err != nil {
+		return err
 	}
 
-	var code uint8
-	code, client.lastError = EncodeMethodScheme(client.method, client.u.Scheme)
-	if client.lastError != nil {
-		return client.lastError
+	log.Printf("write body: %d octets", len(body))
+	if err := tx.writeCharacteristic(p, tx.bodyChr, body, true); err != nil {
+		return err
+	}
+
+	code, err := EncodeMethodScheme(req.method, scheme)
+	if err != nil {
+		return err
 	}
 	log.Printf("write control: %d", code)
-	client.lastError = p.WriteCharacteristic(client.controlChr, []byte{code}, false)
-	if client.lastError != nil {
-		return client.lastError
+	// Even if the write fails, the gateway may have received it
+	tx.mu.Lock()
+	tx.sent = true
+	tx.mu.Unlock()
+	if err := tx.writeCharacteristic(p, tx.controlChr, []byte{code}, false); err != nil {
+		return err
 	}
 
-	log.Printf("waiting for notification, timeout after %v", client.ResponseTimeout)
-	time.AfterFunc(client.ResponseTimeout, func() {
+	log.Printf("waiting for notification, timeout after %v", tx.client.ResponseTimeout)
+	responses := tx.responseChannel
+	t := time.AfterFunc(tx.client.ResponseTimeout, func() {
 		log.Printf("timeout expired, no notification received")
-		client.responseChannel <- false
-	})
-	gotResponse := <-client.responseChannel
-	if gotResponse {
-		client.response.Body, client.lastError = p.ReadCharacteristic(client.bodyChr)
-		if client.lastError != nil {
-			return client.lastError
+		select {
+		case responses <- false:
+		default:
 		}
-		log.Printf("body:    %s", string(client.response.Body))
+	})
+	ok := <-responses
+	t.Stop()
+	if !ok {
+		// Unless the notification failed to decode, which is recorded first
+		return &UpstreamError{Err: ResponseTimeoutError}
+	}
+
+	body, err = tx.readCharacteristic(p, tx.bodyChr)
+	if err != nil {
+		return err
+	}
+	// Only the lengths are logged, the values may be secret
+	log.Printf("read body: %d octets", len(body))
 
-		client.response.Headers, client.lastError = p.ReadCharacteristic(client.hdrsChr)
-		if client.lastError != nil {
-			return client.lastError
+	rh, err := tx.readCharacteristic(p, tx.hdrsChr)
+	if err != nil {
+		return err
+	}
+	log.Printf("read headers: %d octets", len(rh))
+
+	tx.mu.Lock()
+	tx.response.Body, tx.response.Headers = body, rh
+	ns := tx.response.NotifyStatus
+	tx.mu.Unlock()
+
+	streamed := tx.features&FeatureBodySegments != 0 && tx.segmentChr != nil && moreBody(ns, rh, len(body))
+	if streamed {
+		if err := tx.startStream(p, len(body)); err != nil {
+			return err
+		}
+	}
+	if req.compress {
+		tx.mu.Lock()
+		err := decodeResponse(tx.response, streamed)
+		tx.mu.Unlock()
+		if err != nil {
+			return err
 		}
-		log.Printf("headers: %v", formatHeaders(client.response.Headers))
+	}
+
+	// all done no errors!
+	tx.finish(true)
+	return nil
+}
 
-		// all done no errors!
-		client.lastError = nil
-		client.done <- true
+// negotiateFeatures reads the peripheral's capabilities, and picks the
+// extensions to use for the request. Without the characteristic it is plain
+// HPS.
+func (tx *transaction) negotiateFeatures(p gatt.Peripheral) error {
+	var want Feature
+	if tx.client.Encrypt {
+		want |= FeatureEncryption
+	}
+	if tx.req.stream {
+		want |= FeatureBodySegments
+	}
+	if tx.req.compress {
+		want |= FeatureZstd | FeatureGzip | FeatureDeflate | FeatureCompactHeaders
+	}
+	if tx.capsChr == nil {
+		log.Printf("no capabilities, plain HPS")
+		return nil
+	}
+	b, err := readValue(p, tx.capsChr)
+	if err != nil {
+		return err
+	}
+	caps, err := DecodeCapabilities(b)
+	if err != nil {
+		return &DiscoveryError{PeripheralID: p.ID(), UUID: CapabilitiesID, Err: err}
+	}
+	tx.features = negotiate(caps, want)
+	log.Printf("capabilities version: %d, features: %#x, using: %#x", caps.Version, caps.Features, tx.features)
+	if tx.client.Encrypt && caps.Version == ProtocolVersion && !caps.Has(FeatureEncryption) {
+		return HandshakeError
 	}
 	return nil
 }
 
-func formatHeaders(b []byte) []string {
-	s := string(b)
-	sa := strings.Split(s, "\n")
-	return sa
+// handshake runs the key exchange, after which every characteristic value
+// is sealed with the session keys
+func (tx *transaction) handshake(p gatt.Peripheral) error {
+	log.Printf("encryption handshake")
+	if tx.kexChr == nil {
+		return HandshakeError
+	}
+	k, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	if err := p.WriteCharacteristic(tx.kexChr, k.PublicKey(), false); err != nil {
+		return attError("write", tx.kexChr, err)
+	}
+	b, err := readValue(p, tx.kexChr)
+	if err != nil {
+		return err
+	}
+	tx.session, err = DecodeHandshakeReply(k, b, tx.client.PreSharedKey)
+	return err
+}
+
+// writeCharacteristic seals & writes a value
+func (tx *transaction) writeCharacteristic(p gatt.Peripheral, c *gatt.Characteristic, b []byte, noRsp bool) error {
+	return attError("write", c, p.WriteCharacteristic(c, tx.seal(c, b), noRsp))
+}
+
+// readCharacteristic reads & opens a value
+func (tx *transaction) readCharacteristic(p gatt.Peripheral, c *gatt.Characteristic) ([]byte, error) {
+	b, err := readValue(p, c)
+	if err != nil {
+		return nil, err
+	}
+	return tx.open(c, b)
+}
+
+// readValue reads a characteristic, returning an ATTError if the read
+// failed
+func readValue(p gatt.Peripheral, c *gatt.Characteristic) ([]byte, error) {
+	b, err := p.ReadCharacteristic(c)
+	if err == nil {
+		err = readResponseError(c, b)
+	}
+	if err != nil {
+		return nil, attError("read", c, err)
+	}
+	return b, nil
+}
+
+// seal encrypts a value for c, if the link is encrypted
+func (tx *transaction) seal(c *gatt.Characteristic, b []byte) []byte {
+	if tx.session == nil {
+		return b
+	}
+	return tx.session.Seal(c.UUID(), b)
+}
+
+// open decrypts a value from c, if the link is encrypted
+func (tx *transaction) open(c *gatt.Characteristic, b []byte) ([]byte, error) {
+	if tx.session == nil {
+		return b, nil
+	}
+	return tx.session.Open(c.UUID(), b)
 }
@@ -0,0 +1,108 @@
+package hps
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+var requestURITests = []struct {
+	uri    string
+	value  string
+	scheme string
+}{
+	{"http://localhost:8100/hello.txt", "localhost:8100/hello.txt", "http"},
+	{"https://api.example.com/v1/a%20b", "api.example.com/v1/a%20b", "https"},
+	{"/telemetry", "/telemetry", "http"},
+	{"svc://config/flags", "svc://config/flags", "http"},
+}
+
+func TestRequestURI(t *testing.T) {
+	for _, tt := range requestURITests {
+		u, err := url.Parse(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, scheme := requestURI(u)
+		if value != tt.value || scheme != tt.scheme {
+			t.Errorf("requestURI(%q): got %q %q, want %q %q", tt.uri, value, scheme, tt.value, tt.scheme)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	c := MakeClient()
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The second request waits its turn, until its deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := c.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to expire, got %v", err)
+	}
+
+	// queued waits for n requests to be waiting
+	queued := func(n int) {
+		for i := 0; i < 100; i++ {
+			c.mu.Lock()
+			l := len(c.queue)
+			c.mu.Unlock()
+			if l == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expected %d requests waiting", n)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	order := []int{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			c.release()
+		}(i)
+		queued(i + 1)
+
+		// A request that gives up waiting loses its place
+		if i == 1 {
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- c.acquire(ctx) }()
+			queued(i + 2)
+			cancel()
+			if err := <-done; err != context.Canceled {
+				t.Errorf("expected the request to be cancelled, got %v", err)
+			}
+			queued(i + 1)
+		}
+	}
+	mu.Lock()
+	if len(order) != 0 {
+		t.Errorf("expected every request to wait, got %v", order)
+	}
+	mu.Unlock()
+	c.release()
+	wg.Wait()
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Errorf("expected the requests to take turns in order, got %v", order)
+	}
+
+	// The adapter is free again
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.release()
+}
@@ -0,0 +1,190 @@
+package hps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// The compact header encoding fits more headers in HeaderMaxOctets, in the
+// spirit of HPACK. Common names & values are replaced by their index in a
+// static table, and lengths are varints. It starts with a zero octet, which
+// a text header can't, so DecodeHeaders tells them apart. Each field is:
+//
+//	varint 0                  literal name, literal value
+//	varint 2*i+1              name & value of staticTable[i]
+//	varint 2*i+2              name of staticTable[i], literal value
+//
+// where a literal is a varint length followed by the octets. The central
+// writes its request headers compact, with 'X-Hps-Header-Encoding=compact'
+// asking for the response headers compact too, when the peripheral's
+// capabilities have FeatureCompactHeaders.
+
+const (
+	HeaderEncodingHeader  = "X-Hps-Header-Encoding"
+	CompactHeaderEncoding = "compact"
+
+	compactMarker = 0x00
+)
+
+var CompactHeadersError = errors.New("Invalid compact headers")
+
+// staticTable holds the common header names, and values. The index is on
+// the wire, so entries must only ever be appended.
+var staticTable = []struct {
+	name, value string
+}{
+	{"Content-Type", ""},
+	{"Content-Type", "application/json"},
+	{"Content-Type", "text/plain; charset=utf-8"},
+	{"Content-Type", "text/html; charset=utf-8"},
+	{"Content-Type", "application/octet-stream"},
+	{"Content-Length", ""},
+	{"Cache-Control", ""},
+	{"Cache-Control", "no-cache"},
+	{"Cache-Control", "no-store"},
+	{"Cache-Control", "max-age=0"},
+	{"Etag", ""},
+	{"Last-Modified", ""},
+	{"Date", ""},
+	{"Expires", ""},
+	{"Age", ""},
+	{"Vary", ""},
+	{"Vary", "Accept-Encoding"},
+	{"Server", ""},
+	{"Location", ""},
+	{"Set-Cookie", ""},
+	{"Cookie", ""},
+	{"Accept", ""},
+	{"Accept", "*/*"},
+	{"Accept", "application/json"},
+	{"Accept-Encoding", ""},
+	{"Accept-Encoding", "gzip"},
+	{"Accept-Ranges", "bytes"},
+	{"Authorization", ""},
+	{"User-Agent", ""},
+	{"If-None-Match", ""},
+	{"If-Modified-Since", ""},
+	{"Content-Encoding", ""},
+	{"Content-Encoding", "gzip"},
+	{"Connection", "keep-alive"},
+	{"X-Content-Type-Options", "nosniff"},
+	{"Idempotency-Key", ""},
+	{AcceptEncodingHeader, "gzip, deflate"},
+	{ContentEncodingHeader, "gzip"},
+	{ContentEncodingHeader, "deflate"},
+	{HeaderEncodingHeader, CompactHeaderEncoding},
+	{AcceptEncodingHeader, "zstd, gzip, deflate"},
+	{ContentEncodingHeader, "zstd"},
+}
+
+var (
+	staticNames  = map[string]int{}
+	staticFields = map[[2]string]int{}
+)
+
+func init() {
+	for i, e := range staticTable {
+		if e.value == "" {
+			staticNames[e.name] = i
+		} else {
+			staticFields[[2]string{e.name, e.value}] = i
+		}
+	}
+}
+
+// IsCompactHeaders reports whether headers are in the compact encoding
+func IsCompactHeaders(b []byte) bool {
+	return len(b) > 0 && b[0] == compactMarker
+}
+
+// EncodeCompactHeaders is EncodeHeaders with the compact encoding
+func EncodeCompactHeaders(headers http.Header) ([]byte, bool) {
+	return encodeCompactHeaders(headers, HeaderMaxOctets)
+}
+
+func encodeCompactHeaders(headers http.Header, max int) ([]byte, bool) {
+	truncated := false
+	b := []byte{compactMarker}
+	for _, key := range headerNames(headers) {
+		value := strings.Join(headers[key], ", ")
+		f := compactField(http.CanonicalHeaderKey(key), value)
+		if len(b)+len(f) > max {
+			truncated = true
+			break
+		}
+		b = append(b, f...)
+	}
+	return b, truncated
+}
+
+func compactField(name, value string) []byte {
+	if i, ok := staticFields[[2]string{name, value}]; ok {
+		return appendUvarint(nil, uint64(2*i+1))
+	}
+	var b []byte
+	if i, ok := staticNames[name]; ok {
+		b = appendUvarint(b, uint64(2*i+2))
+	} else {
+		b = appendUvarint(b, 0)
+		b = appendLiteral(b, name)
+	}
+	return appendLiteral(b, value)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func appendLiteral(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+// DecodeCompactHeaders decodes the compact encoding, returning the headers
+// decoded before any error
+func DecodeCompactHeaders(b []byte) (http.Header, error) {
+	headers := http.Header{}
+	if !IsCompactHeaders(b) {
+		return headers, CompactHeadersError
+	}
+	r := bytes.NewReader(b[1:])
+	for r.Len() > 0 {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return headers, CompactHeadersError
+		}
+		var name, value string
+		switch {
+		case v == 0:
+			if name, err = readLiteral(r); err != nil {
+				return headers, err
+			}
+		case v%2 == 1 && v/2 < uint64(len(staticTable)):
+			e := staticTable[v/2]
+			headers.Add(e.name, e.value)
+			continue
+		case v%2 == 0 && v/2-1 < uint64(len(staticTable)):
+			name = staticTable[v/2-1].name
+		default:
+			return headers, CompactHeadersError
+		}
+		if value, err = readLiteral(r); err != nil {
+			return headers, err
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
+func readLiteral(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return "", CompactHeadersError
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
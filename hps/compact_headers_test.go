@@ -0,0 +1,80 @@
+package hps
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompactHeaders(t *testing.T) {
+	for _, tt := range headerTests {
+		b, truncated := EncodeCompactHeaders(tt.h)
+		if tt.truncated != truncated {
+			t.Errorf("got %t, want %t", truncated, tt.truncated)
+		}
+		if !IsCompactHeaders(b) {
+			t.Errorf("got %q, want the compact marker", b)
+		}
+		if h := DecodeHeaders(b); !reflect.DeepEqual(h, tt.h) {
+			t.Errorf("got %v, want %v", h, tt.h)
+		}
+	}
+}
+
+func TestCompactHeadersSmaller(t *testing.T) {
+	h := http.Header{
+		"Content-Type":   {"application/json"},
+		"Cache-Control":  {"no-cache"},
+		"Content-Length": {"1024"},
+		"Etag":           {`"33a64df551425fcc55e4d42a148795d9f25f89d4"`},
+		"X-Request-Id":   {"f058ebd6-02f7-4d3f-942e-904344e8cde5"},
+	}
+	text, _ := EncodeHeaders(h)
+	compact, _ := EncodeCompactHeaders(h)
+	if len(compact) >= len(text)*3/4 {
+		t.Errorf("got %d octets, text is %d", len(compact), len(text))
+	}
+
+	// More headers fit before truncating
+	for _, name := range []string{"Set-Cookie", "Cookie", "Authorization", "User-Agent", "Location", "Last-Modified",
+		"Date", "Expires", "Server", "If-None-Match", "If-Modified-Since", "Idempotency-Key"} {
+		h.Set(name, strings.Repeat("b", 30))
+	}
+	if _, truncated := EncodeHeaders(h); !truncated {
+		t.Fatal("text: expected truncation")
+	}
+	if _, truncated := EncodeCompactHeaders(h); truncated {
+		t.Error("compact: got truncated")
+	}
+}
+
+var invalidCompactHeaders = [][]byte{
+	{'a', '=', 'b'},
+	{0x00, 0xff},
+	{0x00, 0x00, 0x05, 'a'},
+	{0x00, 0x7f},
+	{0x00, 0x02, 0x09},
+}
+
+func TestDecodeCompactHeadersInvalid(t *testing.T) {
+	for _, b := range invalidCompactHeaders {
+		if _, err := DecodeCompactHeaders(b); err != CompactHeadersError {
+			t.Errorf("%q: got %v", b, err)
+		}
+	}
+}
+
+func TestDecodeResponseKeepsCompactHeaders(t *testing.T) {
+	b, _ := EncodeCompactHeaders(http.Header{
+		"Content-Type":       {"text/plain"},
+		AcceptEncodingHeader: {"gzip, deflate"},
+	})
+	r := Response{Headers: b}
+	if err := decodeResponse(&r, false); err != nil {
+		t.Fatal(err)
+	}
+	if !IsCompactHeaders(r.Headers) || r.DecodedHeaders().Get(AcceptEncodingHeader) != "" {
+		t.Errorf("got %q", r.Headers)
+	}
+}
@@ -0,0 +1,198 @@
+package hps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Bodies are compressed over the BLE link, independently of any
+// Content-Encoding between the peripheral & upstream. The central picks the
+// encodings from the peripheral's capabilities, see FeatureGzip, and lists
+// them in the request headers:
+//
+//	central    -> X-Hps-Accept-Encoding=zstd, gzip, deflate
+//	              X-Hps-Content-Encoding=gzip, if the body is compressed
+//	peripheral -> X-Hps-Content-Encoding=gzip
+//
+// A compressed body's Content-Length is its length on the link. The link
+// headers are removed before the request is sent upstream, or the response
+// is returned to the caller.
+
+const (
+	AcceptEncodingHeader  = "X-Hps-Accept-Encoding"
+	ContentEncodingHeader = "X-Hps-Content-Encoding"
+)
+
+// Encodings are the link encodings supported, in order of preference.
+// "deflate" is the zlib format, as in HTTP.
+var Encodings = []string{"zstd", "gzip", "deflate"}
+
+var UnsupportedEncodingError = errors.New("Unsupported link encoding")
+
+// NegotiateEncoding picks the first encoding in accept, a comma separated
+// list, that is supported. It is empty if there are none.
+func NegotiateEncoding(accept string) string {
+	for _, e := range strings.Split(accept, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		for _, s := range Encodings {
+			if e == s {
+				return e
+			}
+		}
+	}
+	return ""
+}
+
+// Encode compresses a body with the encoding
+func Encode(encoding string, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	case "deflate":
+		w, _ = zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	case "zstd":
+		w, _ = zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, UnsupportedEncodingError
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decompresses a body with the encoding
+func Decode(encoding string, b []byte) ([]byte, error) {
+	r, err := newDecoder(encoding, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "zstd":
+		// One goroutine, the bodies are small
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, UnsupportedEncodingError
+}
+
+// decodingBody decompresses a streamed body as it is read. The decoder is
+// made on the first read, as it reads the stream's header.
+type decodingBody struct {
+	encoding string
+	r        io.Reader
+	dec      io.ReadCloser
+	err      error
+	closer   io.Closer
+}
+
+func (b *decodingBody) Read(p []byte) (int, error) {
+	if b.dec == nil && b.err == nil {
+		b.dec, b.err = newDecoder(b.encoding, b.r)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.dec.Read(p)
+}
+
+func (b *decodingBody) Close() error {
+	if b.dec != nil {
+		b.dec.Close()
+	}
+	return b.closer.Close()
+}
+
+// decodeResponse decompresses a response body sent with a link encoding,
+// and removes the link headers. A streamed body is decompressed as it is
+// read, see newHTTPResponse.
+func decodeResponse(r *Response, streamed bool) error {
+	h := r.DecodedHeaders()
+	l := StripLinkHeaders(h)
+	encoding := l.ContentEncoding
+	if l == (LinkHeaders{}) {
+		return nil
+	}
+	switch {
+	case encoding == "":
+	case streamed:
+		r.encoding = encoding
+		h.Del("Content-Length")
+	default:
+		b, err := Decode(encoding, r.Body)
+		if err != nil {
+			return fmt.Errorf("Decode %s body, err: %w", encoding, err)
+		}
+		r.Body = b
+		if h.Get("Content-Length") != "" {
+			h.Set("Content-Length", strconv.Itoa(len(b)))
+		}
+	}
+	if IsCompactHeaders(r.Headers) {
+		r.Headers, _ = EncodeCompactHeaders(h)
+	} else {
+		r.Headers, _ = EncodeHeaders(h)
+	}
+	return nil
+}
+
+// encodeRequestBody compresses a request body with an encoding the
+// peripheral accepts, if that makes it smaller, adding the link header
+func encodeRequestBody(accepts string, headers ArrayStr, body []byte) (ArrayStr, []byte) {
+	encoding := NegotiateEncoding(accepts)
+	if encoding == "" || len(body) == 0 {
+		return headers, body
+	}
+	b, err := Encode(encoding, body)
+	if err != nil || len(b) >= len(body) {
+		return headers, body
+	}
+	return append(append(ArrayStr{}, headers...), ContentEncodingHeader+"="+encoding), b
+}
+
+// LinkHeaders negotiate the encodings over the BLE link
+type LinkHeaders struct {
+	AcceptEncoding  string
+	ContentEncoding string
+	HeaderEncoding  string
+}
+
+// StripLinkHeaders returns the link headers in h, and removes them
+func StripLinkHeaders(h http.Header) LinkHeaders {
+	l := LinkHeaders{
+		AcceptEncoding:  h.Get(AcceptEncodingHeader),
+		ContentEncoding: h.Get(ContentEncodingHeader),
+		HeaderEncoding:  h.Get(HeaderEncodingHeader),
+	}
+	h.Del(AcceptEncodingHeader)
+	h.Del(ContentEncodingHeader)
+	h.Del(HeaderEncodingHeader)
+	return l
+}
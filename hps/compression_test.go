@@ -0,0 +1,129 @@
+package hps
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var negotiateTests = []struct {
+	accept, want string
+}{
+	{"gzip, deflate", "gzip"},
+	{"zstd, deflate", "zstd"},
+	{"br, deflate", "deflate"},
+	{" GZIP ", "gzip"},
+	{"br", ""},
+	{"", ""},
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tt := range negotiateTests {
+		if got := NegotiateEncoding(tt.accept); got != tt.want {
+			t.Errorf("NegotiateEncoding(%q): got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	body := []byte(strings.Repeat(`{"temperature":21.5,"humidity":40}`, 20))
+	for _, e := range Encodings {
+		b, err := Encode(e, body)
+		if err != nil || len(b) >= len(body) {
+			t.Errorf("%s: got %d octets, err: %v", e, len(b), err)
+		}
+		d, err := Decode(e, b)
+		if err != nil || !bytes.Equal(d, body) {
+			t.Errorf("%s: decoded %q, err: %v", e, d, err)
+		}
+	}
+	if _, err := Encode("br", body); err != UnsupportedEncodingError {
+		t.Errorf("br: got %v", err)
+	}
+	if _, err := Decode("zstd", []byte("not zstd")); err == nil {
+		t.Errorf("zstd: decoded an invalid body")
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	body := []byte(strings.Repeat("hello ", 50))
+	b, _ := Encode("gzip", body)
+	h := http.Header{
+		"Content-Type":        {"text/plain"},
+		"Content-Length":      {"1"},
+		AcceptEncodingHeader:  {"gzip, deflate"},
+		ContentEncodingHeader: {"gzip"},
+	}
+	headers, _ := EncodeHeaders(h)
+
+	r := Response{Headers: headers, Body: b}
+	if err := decodeResponse(&r, false); err != nil || !bytes.Equal(r.Body, body) {
+		t.Fatalf("got %q, err: %v", r.Body, err)
+	}
+	got := r.DecodedHeaders()
+	if got.Get(ContentEncodingHeader) != "" || got.Get(AcceptEncodingHeader) != "" || got.Get("Content-Length") != "300" {
+		t.Errorf("headers: got %v", got)
+	}
+
+	// A streamed body is decompressed as it is read
+	r = Response{Headers: headers, Body: b[:10], stream: &bodyStream{buf: b[10:], err: io.EOF}}
+	if err := decodeResponse(&r, true); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8100/hello.txt", nil)
+	resp := newHTTPResponse(req, r)
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil || !bytes.Equal(d, body) || resp.ContentLength != -1 {
+		t.Errorf("streamed: got %q, length: %d, err: %v", d, resp.ContentLength, err)
+	}
+	resp.Body.Close()
+}
+
+func TestDecodeStreamedEncodings(t *testing.T) {
+	body := []byte(strings.Repeat("hello ", 50))
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8100/hello.txt", nil)
+	for _, e := range Encodings {
+		b, _ := Encode(e, body)
+		headers, _ := EncodeHeaders(http.Header{ContentEncodingHeader: {e}})
+		r := Response{Headers: headers, Body: b[:10], stream: &bodyStream{buf: b[10:], err: io.EOF}}
+		if err := decodeResponse(&r, true); err != nil {
+			t.Fatal(err)
+		}
+		resp := newHTTPResponse(req, r)
+		d, err := ioutil.ReadAll(resp.Body)
+		if err != nil || !bytes.Equal(d, body) {
+			t.Errorf("%s: got %q, err: %v", e, d, err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestEncodeRequestBody(t *testing.T) {
+	body := []byte(strings.Repeat("a", 100))
+	headers, b := encodeRequestBody("deflate", ArrayStr{"Content-Type=text/plain"}, body)
+	if headers.Header().Get(ContentEncodingHeader) != "deflate" || len(b) >= len(body) {
+		t.Errorf("got %v, %d octets", headers, len(b))
+	}
+	headers, b = encodeRequestBody("", ArrayStr{}, body)
+	if len(headers) != 0 || !bytes.Equal(b, body) {
+		t.Errorf("not accepted: got %v, %d octets", headers, len(b))
+	}
+	headers, b = encodeRequestBody("gzip", ArrayStr{}, []byte("a"))
+	if len(headers) != 0 || string(b) != "a" {
+		t.Errorf("incompressible: got %v, %q", headers, b)
+	}
+}
+
+func TestEncodeHeadersKeepsLinkHeaders(t *testing.T) {
+	h := http.Header{ContentEncodingHeader: {"gzip"}}
+	for i := 0; i < 20; i++ {
+		h.Set("X-Padding-"+strings.Repeat("a", i), strings.Repeat("b", 40))
+	}
+	b, truncated := EncodeHeaders(h)
+	if !truncated || DecodeHeaders(b).Get(ContentEncodingHeader) != "gzip" {
+		t.Errorf("got truncated: %v, %q", truncated, b)
+	}
+}
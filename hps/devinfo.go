@@ -0,0 +1,73 @@
+package hps
+
+import (
+	"errors"
+
+	"github.com/paypal/gatt"
+)
+
+var DeviceInfoMissingError = errors.New("Device Information Service not found")
+
+// DeviceInfo is the content of the Device Information Service, identifying
+// the peripheral's software & hardware
+type DeviceInfo struct {
+	Manufacturer     string
+	Model            string
+	Serial           string
+	HardwareRevision string
+	FirmwareRevision string
+	SoftwareRevision string
+}
+
+// fields maps the characteristics to their values
+func (i *DeviceInfo) fields() map[uint16]*string {
+	return map[uint16]*string{
+		ManufacturerNameID: &i.Manufacturer,
+		ModelNumberID:      &i.Model,
+		SerialNumberID:     &i.Serial,
+		HardwareRevisionID: &i.HardwareRevision,
+		FirmwareRevisionID: &i.FirmwareRevision,
+		SoftwareRevisionID: &i.SoftwareRevision,
+	}
+}
+
+// NewDeviceInfoService returns a read only Device Information Service,
+// empty values are left out
+func NewDeviceInfoService(info DeviceInfo) *gatt.Service {
+	s := gatt.NewService(gatt.UUID16(DeviceInformationID))
+	for _, id := range []uint16{ManufacturerNameID, ModelNumberID, SerialNumberID, HardwareRevisionID, FirmwareRevisionID, SoftwareRevisionID} {
+		if v := *info.fields()[id]; v != "" {
+			s.AddCharacteristic(gatt.UUID16(id)).SetValue([]byte(v))
+		}
+	}
+	return s
+}
+
+// readDeviceInfo reads the Device Information Service from a connected
+// peripheral
+func readDeviceInfo(p gatt.Peripheral, ss []*gatt.Service) (DeviceInfo, error) {
+	var info DeviceInfo
+	for _, s := range ss {
+		if !s.UUID().Equal(gatt.UUID16(DeviceInformationID)) {
+			continue
+		}
+		cs, err := p.DiscoverCharacteristics(nil, s)
+		if err != nil {
+			return info, &DiscoveryError{PeripheralID: p.ID(), UUID: s.UUID().String(), Err: err}
+		}
+		fields := info.fields()
+		for _, c := range cs {
+			for id, v := range fields {
+				if c.UUID().Equal(gatt.UUID16(id)) {
+					b, err := readValue(p, c)
+					if err != nil {
+						return info, err
+					}
+					*v = string(b)
+				}
+			}
+		}
+		return info, nil
+	}
+	return info, &DiscoveryError{PeripheralID: p.ID(), UUID: gatt.UUID16(DeviceInformationID).String(), Err: DeviceInfoMissingError}
+}
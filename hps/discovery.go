@@ -0,0 +1,118 @@
+package hps
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/paypal/gatt"
+)
+
+// candidate is a peripheral found while scanning
+type candidate struct {
+	p    gatt.Peripheral
+	rssi int
+
+	// info is from the manufacturer data, if the gateway advertises it
+	info    GatewayInfo
+	hasInfo bool
+}
+
+// load is the advertised load, gateways that don't advertise it come last
+func (c candidate) load() int {
+	if !c.hasInfo {
+		return 256
+	}
+	return int(c.info.Load)
+}
+
+// candidates collects the peripherals matching the client's selection,
+// during the scan window
+type candidates struct {
+	mu     sync.Mutex
+	found  map[string]candidate
+	closed bool
+}
+
+// add records a candidate, and reports whether the scan window has closed
+func (c *candidates) add(p gatt.Peripheral, a *gatt.Advertisement, rssi int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.found == nil {
+		c.found = map[string]candidate{}
+	}
+	f := candidate{p: p, rssi: rssi}
+	f.info, f.hasInfo = decodeGatewayInfo(a)
+	c.found[p.ID()] = f
+	return c.closed
+}
+
+// close ends the scan window, returning the candidate picked by choose
+func (c *candidates) close(choose func([]candidate) (candidate, bool)) (gatt.Peripheral, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	var cs []candidate
+	for _, f := range c.found {
+		cs = append(cs, f)
+	}
+	f, ok := choose(cs)
+	return f.p, ok
+}
+
+func decodeGatewayInfo(a *gatt.Advertisement) (GatewayInfo, bool) {
+	if a == nil || len(a.ManufacturerData) == 0 {
+		return GatewayInfo{}, false
+	}
+	// Any company ID, gateways may be configured with their own
+	companyID := uint16(a.ManufacturerData[0])
+	if len(a.ManufacturerData) > 1 {
+		companyID |= uint16(a.ManufacturerData[1]) << 8
+	}
+	info, err := DecodeGatewayInfo(a.ManufacturerData, companyID)
+	return info, err == nil
+}
+
+func (c *candidates) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.found = nil
+	c.closed = false
+}
+
+// scanFilter returns the services to scan for, the HPS service unless
+// ServiceUUID is set
+func (client *Client) scanFilter() ([]gatt.UUID, error) {
+	if client.ServiceUUID == "" {
+		return []gatt.UUID{gatt.MustParseUUID(HpsServiceID)}, nil
+	}
+	u, err := gatt.ParseUUID(client.ServiceUUID)
+	if err != nil {
+		return nil, err
+	}
+	return []gatt.UUID{u}, nil
+}
+
+// matches reports whether a discovered peripheral meets every selection
+// option that is set, scanFor is from scanFilter
+func (client *Client) matches(scanFor []gatt.UUID, id, name string, a *gatt.Advertisement, rssi int) bool {
+	if client.PeripheralID != "" && !strings.EqualFold(id, client.PeripheralID) {
+		return false
+	}
+	if client.DeviceName != "" && name != client.DeviceName {
+		return false
+	}
+	if client.MinRSSI != 0 && rssi < client.MinRSSI {
+		return false
+	}
+	if client.ServiceUUID != "" {
+		for _, s := range a.Services {
+			for _, u := range scanFor {
+				if s.Equal(u) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package hps
+
+import (
+	"testing"
+
+	"github.com/paypal/gatt"
+)
+
+var hpsAdvertisement = &gatt.Advertisement{Services: []gatt.UUID{gatt.MustParseUUID(HpsServiceID)}}
+
+var matchTests = []struct {
+	client Client
+	id     string
+	name   string
+	a      *gatt.Advertisement
+	rssi   int
+	match  bool
+}{
+	{Client{}, "B8:27:EB:00:00:01", "", &gatt.Advertisement{}, -90, true},
+	{Client{DeviceName: DeviceName}, "B8:27:EB:00:00:01", DeviceName, hpsAdvertisement, -60, true},
+	{Client{DeviceName: DeviceName}, "B8:27:EB:00:00:01", "other", hpsAdvertisement, -60, false},
+	{Client{PeripheralID: "b8:27:eb:00:00:01"}, "B8:27:EB:00:00:01", "", hpsAdvertisement, -60, true},
+	{Client{PeripheralID: "B8:27:EB:00:00:02"}, "B8:27:EB:00:00:01", "", hpsAdvertisement, -60, false},
+	{Client{MinRSSI: -70}, "B8:27:EB:00:00:01", "", hpsAdvertisement, -60, true},
+	{Client{MinRSSI: -70}, "B8:27:EB:00:00:01", "", hpsAdvertisement, -80, false},
+	{Client{ServiceUUID: HpsServiceID}, "B8:27:EB:00:00:01", "", hpsAdvertisement, -60, true},
+	{Client{ServiceUUID: HpsServiceID}, "B8:27:EB:00:00:01", "", &gatt.Advertisement{}, -60, false},
+	{Client{ServiceUUID: "180A"}, "B8:27:EB:00:00:01", "", hpsAdvertisement, -60, false},
+}
+
+func TestMatches(t *testing.T) {
+	for i := range matchTests {
+		tt := &matchTests[i]
+		scanFor, err := tt.client.scanFilter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.client.matches(scanFor, tt.id, tt.name, tt.a, tt.rssi); got != tt.match {
+			t.Errorf("%d: got %t, want %t", i, got, tt.match)
+		}
+	}
+	c := Client{ServiceUUID: "not a uuid"}
+	if _, err := c.scanFilter(); err == nil {
+		t.Errorf("expected an error for an invalid service UUID")
+	}
+}
+
+type testPeripheral struct {
+	gatt.Peripheral
+	id string
+}
+
+func (p testPeripheral) ID() string { return p.id }
+
+func TestCandidates(t *testing.T) {
+	strongest := func(cs []candidate) (candidate, bool) { return choose(cs, BalanceRSSI, "") }
+	var c candidates
+	if _, ok := c.close(strongest); ok {
+		t.Errorf("expected no candidates")
+	}
+	c.reset()
+	c.add(testPeripheral{id: "a"}, nil, -80)
+	c.add(testPeripheral{id: "b"}, nil, -50)
+	c.add(testPeripheral{id: "c"}, nil, -70)
+	// The latest RSSI replaces an earlier one
+	if closed := c.add(testPeripheral{id: "a"}, nil, -90); closed {
+		t.Errorf("window closed early")
+	}
+	p, ok := c.close(strongest)
+	if !ok || p.ID() != "b" {
+		t.Errorf("got %v, want the strongest signal b", p)
+	}
+	if closed := c.add(testPeripheral{id: "d"}, nil, -40); !closed {
+		t.Errorf("expected the window to be closed")
+	}
+}
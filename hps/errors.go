@@ -0,0 +1,229 @@
+package hps
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/paypal/gatt"
+)
+
+// Errors from Client.Do are one of the types below, for the phase of the
+// request that failed. Each wraps the underlying error, eg: the gatt error,
+// so use errors.Is & errors.As to inspect them:
+//
+//	var attErr *hps.ATTError
+//	if errors.As(err, &attErr) && attErr.Code == hps.ATTInsufficientAuthentication {
+//		...
+//	}
+//	if errors.Is(err, hps.ConnectionTimeoutError) {
+//		...
+//	}
+
+var (
+	// CharacteristicMissingError is wrapped in a DiscoveryError when a
+	// required characteristic isn't found
+	CharacteristicMissingError = errors.New("Characteristic not found")
+	// ServiceMissingError is wrapped in a DiscoveryError when the
+	// peripheral doesn't have the HPS service
+	ServiceMissingError = errors.New("HPS service not found")
+	// ResponseTimeoutError is wrapped in an UpstreamError when no response
+	// was notified within ResponseTimeout
+	ResponseTimeoutError = errors.New("Response timeout")
+)
+
+// ScanError is returned when no matching gateway was found, wrapping
+// ConnectionTimeoutError, or the adapter couldn't scan
+type ScanError struct {
+	Err error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("Scan failed: %v", e.Err)
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectError is returned when connecting to the gateway failed, or it
+// disconnected before the response was read, wrapping DisconnectedError
+type ConnectError struct {
+	PeripheralID string
+	Err          error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("Connection to peripheral_id: %s failed: %v", e.PeripheralID, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// DiscoveryError is returned when discovering the gateway's services or
+// characteristics failed, or a required one is missing. UUID is the
+// service or characteristic, if known.
+type DiscoveryError struct {
+	PeripheralID string
+	UUID         string
+	Err          error
+}
+
+func (e *DiscoveryError) Error() string {
+	if e.UUID == "" {
+		return fmt.Sprintf("Discovery on peripheral_id: %s failed: %v", e.PeripheralID, e.Err)
+	}
+	return fmt.Sprintf("Discovery of %s on peripheral_id: %s failed: %v", e.UUID, e.PeripheralID, e.Err)
+}
+
+func (e *DiscoveryError) Unwrap() error {
+	return e.Err
+}
+
+// ATT error codes, from the Bluetooth Core Specification Vol 3, Part F,
+// 3.4.1.1
+const (
+	ATTInvalidHandle              uint8 = 0x01
+	ATTReadNotPermitted           uint8 = 0x02
+	ATTWriteNotPermitted          uint8 = 0x03
+	ATTInvalidPDU                 uint8 = 0x04
+	ATTInsufficientAuthentication uint8 = 0x05
+	ATTRequestNotSupported        uint8 = 0x06
+	ATTInvalidOffset              uint8 = 0x07
+	ATTInsufficientAuthorization  uint8 = 0x08
+	ATTPrepareQueueFull           uint8 = 0x09
+	ATTAttributeNotFound          uint8 = 0x0A
+	ATTAttributeNotLong           uint8 = 0x0B
+	ATTInsufficientKeySize        uint8 = 0x0C
+	ATTInvalidValueLength         uint8 = 0x0D
+	ATTUnlikelyError              uint8 = 0x0E
+	ATTInsufficientEncryption     uint8 = 0x0F
+	ATTUnsupportedGroupType       uint8 = 0x10
+	ATTInsufficientResources      uint8 = 0x11
+)
+
+var attCodeText = map[uint8]string{
+	ATTInvalidHandle:              "invalid handle",
+	ATTReadNotPermitted:           "read not permitted",
+	ATTWriteNotPermitted:          "write not permitted",
+	ATTInvalidPDU:                 "invalid PDU",
+	ATTInsufficientAuthentication: "insufficient authentication",
+	ATTRequestNotSupported:        "request not supported",
+	ATTInvalidOffset:              "invalid offset",
+	ATTInsufficientAuthorization:  "insufficient authorization",
+	ATTPrepareQueueFull:           "prepare queue full",
+	ATTAttributeNotFound:          "attribute not found",
+	ATTAttributeNotLong:           "attribute not long",
+	ATTInsufficientKeySize:        "insufficient encryption key size",
+	ATTInvalidValueLength:         "invalid attribute value length",
+	ATTUnlikelyError:              "unlikely error",
+	ATTInsufficientEncryption:     "insufficient encryption",
+	ATTUnsupportedGroupType:       "unsupported group type",
+	ATTInsufficientResources:      "insufficient resources",
+}
+
+// attStatus is an ATT error code received from the peripheral
+type attStatus uint8
+
+func (s attStatus) Error() string {
+	if t, ok := attCodeText[uint8(s)]; ok {
+		return t
+	}
+	return fmt.Sprintf("ATT error 0x%02X", uint8(s))
+}
+
+// ATTError is returned when a GATT operation on the peripheral fails. Code
+// is the ATT error code, or 0 when gatt doesn't report it.
+type ATTError struct {
+	Op   string
+	UUID string
+	Code uint8
+	Err  error
+}
+
+func (e *ATTError) Error() string {
+	if e.UUID == "" {
+		return fmt.Sprintf("ATT %s failed: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("ATT %s %s failed: %v", e.Op, e.UUID, e.Err)
+}
+
+func (e *ATTError) Unwrap() error {
+	return e.Err
+}
+
+// attError wraps an error from a GATT operation on c, if there is one
+func attError(op string, c *gatt.Characteristic, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &ATTError{Op: op, Code: attCode(err), Err: err}
+	if c != nil {
+		e.UUID = c.UUID().String()
+	}
+	return e
+}
+
+// gattPkgPath is the package gatt's ATT error codes are defined in
+const gattPkgPath = "github.com/paypal/gatt"
+
+// attCode returns the ATT error code from a gatt error. On macOS gatt returns
+// the code as its unexported attEcode, a byte implementing error, with no
+// exported way to get at it, so it is read by reflection. On Linux gatt
+// returns the error response as the value instead, see readResponseError.
+// TestGattATTErrorType fails if gatt's type changes.
+func attCode(err error) uint8 {
+	if s, ok := err.(attStatus); ok {
+		return uint8(s)
+	}
+	v := reflect.ValueOf(err)
+	if v.Kind() == reflect.Uint8 && v.Type().PkgPath() == gattPkgPath {
+		return uint8(v.Uint())
+	}
+	return 0
+}
+
+// attOpReadReq is the ATT Read Request opcode
+const attOpReadReq = 0x0A
+
+// readResponseError detects an ATT error response to a read of c. On Linux
+// gatt returns the error response as the value, less its opcode: the
+// request opcode, the handle & the error code.
+func readResponseError(c *gatt.Characteristic, b []byte) error {
+	if len(b) == 4 && b[0] == attOpReadReq && binary.LittleEndian.Uint16(b[1:]) == c.VHandle() {
+		return attStatus(b[3])
+	}
+	return nil
+}
+
+// UpstreamError is returned when the gateway replied with a 502, 503 or 504
+// status, or didn't reply within ResponseTimeout, wrapping
+// ResponseTimeoutError. The response is returned with it.
+type UpstreamError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Upstream failed: %v", e.Err)
+	}
+	return fmt.Sprintf("Upstream failed: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// upstreamError returns an UpstreamError for a response whose status shows
+// the gateway couldn't complete the request upstream
+func upstreamError(r Response) error {
+	switch r.NotifyStatus.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return &UpstreamError{StatusCode: r.NotifyStatus.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package hps
+
+import (
+	"errors"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"net/http"
+	"testing"
+
+	"github.com/paypal/gatt"
+)
+
+func TestErrorsWrap(t *testing.T) {
+	gattErr := errors.New("gatt failure")
+	c := gatt.NewCharacteristic(gatt.UUID16(HTTPControlPointID), nil, gatt.CharWrite, 0x20, 0x21)
+	errs := []struct {
+		err    error
+		target interface{}
+		is     error
+	}{
+		{&ScanError{Err: ConnectionTimeoutError}, new(*ScanError), ConnectionTimeoutError},
+		{&ConnectError{PeripheralID: "a", Err: DisconnectedError}, new(*ConnectError), DisconnectedError},
+		{&ConnectError{PeripheralID: "a", Err: attError("exchange MTU", nil, gattErr)}, new(*ATTError), gattErr},
+		{&DiscoveryError{PeripheralID: "a", UUID: HpsServiceID, Err: ServiceMissingError}, new(*DiscoveryError), ServiceMissingError},
+		{attError("write", c, gattErr), new(*ATTError), gattErr},
+		{&UpstreamError{Err: ResponseTimeoutError}, new(*UpstreamError), ResponseTimeoutError},
+	}
+	for _, tt := range errs {
+		if !errors.As(tt.err, tt.target) {
+			t.Errorf("%v: errors.As %T failed", tt.err, tt.target)
+		}
+		if !errors.Is(tt.err, tt.is) {
+			t.Errorf("%v: errors.Is %v failed", tt.err, tt.is)
+		}
+	}
+	if attError("write", c, nil) != nil {
+		t.Errorf("expected no error")
+	}
+}
+
+func TestReadResponseError(t *testing.T) {
+	c := gatt.NewCharacteristic(gatt.UUID16(HTTPEntityBodyID), nil, gatt.CharRead, 0x20, 0x21)
+	err := attError("read", c, readResponseError(c, []byte{attOpReadReq, 0x21, 0x00, ATTReadNotPermitted}))
+	var attErr *ATTError
+	if !errors.As(err, &attErr) || attErr.Code != ATTReadNotPermitted || attErr.UUID != c.UUID().String() {
+		t.Errorf("expected read not permitted, got %v", err)
+	}
+	if want := "ATT read " + c.UUID().String() + " failed: read not permitted"; err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+	// A value that happens to be 4 octets, for a different handle
+	if err := readResponseError(c, []byte{attOpReadReq, 0x22, 0x00, 0x02}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if err := readResponseError(c, []byte("body")); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	for code, want := range map[int]bool{
+		http.StatusOK:                  false,
+		http.StatusNotFound:            false,
+		http.StatusInternalServerError: false,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+	} {
+		err := upstreamError(statusResponse(code))
+		var upstreamErr *UpstreamError
+		if got := errors.As(err, &upstreamErr); got != want || (got && upstreamErr.StatusCode != code) {
+			t.Errorf("upstreamError(%d): got %v", code, err)
+		}
+	}
+	if !failover(Response{}, upstreamError(statusResponse(http.StatusBadGateway))) ||
+		failover(Response{}, upstreamError(statusResponse(http.StatusGatewayTimeout))) ||
+		!failover(Response{}, &UpstreamError{Err: ResponseTimeoutError}) ||
+		!failover(Response{}, &ConnectError{Err: DisconnectedError}) ||
+		failover(Response{}, &DiscoveryError{Err: CharacteristicMissingError}) {
+		t.Errorf("failover")
+	}
+}
+
+// TestGattATTErrorType checks that gatt's ATT error codes are still the
+// byte type attCode reads by reflection, type checking gatt's source
+func TestGattATTErrorType(t *testing.T) {
+	pkg, err := importer.ForCompiler(token.NewFileSet(), "source", nil).Import(gattPkgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, ok := pkg.Scope().Lookup("attEcode").(*types.TypeName)
+	if !ok {
+		t.Fatalf("gatt.attEcode not found")
+	}
+	if u := obj.Type().Underlying(); !types.Identical(u, types.Typ[types.Uint8]) {
+		t.Errorf("gatt.attEcode is %v, not a byte", u)
+	}
+	errType := types.Universe.Lookup("error").Type().Underlying().(*types.Interface)
+	if !types.Implements(obj.Type(), errType) {
+		t.Errorf("gatt.attEcode doesn't implement error")
+	}
+}
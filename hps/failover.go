@@ -0,0 +1,154 @@
+package hps
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Balance orders the gateways found while scanning
+type Balance int
+
+const (
+	// BalanceFirst connects to the first gateway found
+	BalanceFirst Balance = iota
+	// BalanceRSSI prefers the strongest signal
+	BalanceRSSI
+	// BalanceRoundRobin takes turns between the gateways found
+	BalanceRoundRobin
+	// BalanceLoad prefers the gateway advertising the lowest load, see
+	// GatewayInfo
+	BalanceLoad
+)
+
+const (
+	// balanceWindow is how long to scan for when balancing between gateways
+	// and no ScanWindow is set
+	balanceWindow = time.Second
+
+	failureBackoff    = time.Second
+	maxFailureBackoff = time.Minute
+)
+
+// gatewayHealth tracks the failures of one gateway, it is skipped until
+// the backoff expires
+type gatewayHealth struct {
+	failures int
+	until    time.Time
+}
+
+func (h *gatewayHealth) failed(now time.Time) {
+	h.failures++
+	backoff := failureBackoff << uint(h.failures-1)
+	if backoff > maxFailureBackoff || backoff <= 0 {
+		backoff = maxFailureBackoff
+	}
+	h.until = now.Add(backoff)
+}
+
+// GatewayHealth reports the gateways in backoff after failing, by peripheral
+// ID, and when they will next be tried
+func (client *Client) GatewayHealth() map[string]time.Time {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	m := map[string]time.Time{}
+	for id, h := range client.health {
+		if h.failures > 0 {
+			m[id] = h.until
+		}
+	}
+	return m
+}
+
+// recordHealth updates the gateway's health after a request
+func (client *Client) recordHealth(id string, ok bool, now time.Time) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.health == nil {
+		client.health = map[string]*gatewayHealth{}
+	}
+	if ok {
+		delete(client.health, id)
+		return
+	}
+	h, found := client.health[id]
+	if !found {
+		h = &gatewayHealth{}
+		client.health[id] = h
+	}
+	h.failed(now)
+}
+
+// healthy reports whether the gateway isn't in backoff
+func (client *Client) healthy(id string, now time.Time) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	h, ok := client.health[id]
+	return !ok || !now.Before(h.until)
+}
+
+// balanceWindow is how long to collect gateways for before choosing one
+func (client *Client) balanceWindow() time.Duration {
+	if client.ScanWindow == 0 && client.Balance != BalanceFirst {
+		return balanceWindow
+	}
+	return client.ScanWindow
+}
+
+// choose picks a gateway from the candidates, following the balance
+// strategy. last is the previous gateway used, for round-robin.
+func choose(cs []candidate, b Balance, last string) (candidate, bool) {
+	if len(cs) == 0 {
+		return candidate{}, false
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].p.ID() < cs[j].p.ID() })
+	best := 0
+	switch b {
+	case BalanceRoundRobin:
+		for i, c := range cs {
+			if c.p.ID() > last {
+				return cs[i], true
+			}
+		}
+		return cs[0], true
+	case BalanceLoad:
+		for i, c := range cs {
+			if c.load() < cs[best].load() || (c.load() == cs[best].load() && c.rssi > cs[best].rssi) {
+				best = i
+			}
+		}
+	default:
+		for i, c := range cs {
+			if c.rssi > cs[best].rssi {
+				best = i
+			}
+		}
+	}
+	return cs[best], true
+}
+
+// failover reports whether another gateway should be tried after a request
+// through this one failed: it timed out, disconnected, or replied 502 or 503
+func failover(r Response, err error) bool {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.Err == nil {
+		r.NotifyStatus.StatusCode = upstreamErr.StatusCode
+	} else if err != nil {
+		var connectErr *ConnectError
+		return errors.Is(err, ConnectionTimeoutError) || errors.Is(err, DisconnectedError) ||
+			errors.Is(err, ResponseTimeoutError) || errors.As(err, &connectErr)
+	}
+	switch r.NotifyStatus.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// resend reports whether a request that failed over may be sent to another
+// gateway. Once sent, the gateway may have made the upstream call, so only
+// idempotent requests are, see Idempotent.
+func resend(method string, h http.Header, sent bool) bool {
+	return !sent || Idempotent(method, h)
+}
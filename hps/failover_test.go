@@ -0,0 +1,122 @@
+package hps
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func testCandidate(id string, rssi int, load int) candidate {
+	c := candidate{p: testPeripheral{id: id}, rssi: rssi}
+	if load >= 0 {
+		c.info, c.hasInfo = GatewayInfo{Load: uint8(load)}, true
+	}
+	return c
+}
+
+var chooseTests = []struct {
+	b    Balance
+	last string
+	want string
+}{
+	{BalanceRSSI, "", "b"},
+	{BalanceLoad, "", "c"},
+	{BalanceRoundRobin, "", "a"},
+	{BalanceRoundRobin, "a", "b"},
+	{BalanceRoundRobin, "b", "c"},
+	{BalanceRoundRobin, "d", "a"},
+}
+
+func TestChoose(t *testing.T) {
+	for _, tt := range chooseTests {
+		cs := []candidate{testCandidate("d", -90, -1), testCandidate("c", -80, 10), testCandidate("b", -50, 90), testCandidate("a", -70, 10)}
+		// a & c have the same load, make c the stronger signal
+		if tt.b == BalanceLoad {
+			cs[3].rssi = -85
+		}
+		c, ok := choose(cs, tt.b, tt.last)
+		if !ok || c.p.ID() != tt.want {
+			t.Errorf("choose(%d, %q): got %v, want %s", tt.b, tt.last, c.p, tt.want)
+		}
+	}
+	if _, ok := choose(nil, BalanceRSSI, ""); ok {
+		t.Errorf("expected no candidate")
+	}
+}
+
+func TestGatewayHealth(t *testing.T) {
+	c := MakeClient()
+	now := time.Now()
+	c.recordHealth("a", false, now)
+	if c.healthy("a", now.Add(time.Millisecond*500)) || !c.healthy("a", now.Add(failureBackoff)) {
+		t.Errorf("expected a %v backoff", failureBackoff)
+	}
+	c.recordHealth("a", false, now)
+	if c.healthy("a", now.Add(failureBackoff)) || !c.healthy("a", now.Add(failureBackoff*2)) {
+		t.Errorf("expected the backoff to double")
+	}
+	for i := 0; i < 100; i++ {
+		c.recordHealth("a", false, now)
+	}
+	if !c.healthy("a", now.Add(maxFailureBackoff)) {
+		t.Errorf("expected the backoff to be capped at %v", maxFailureBackoff)
+	}
+	if _, ok := c.GatewayHealth()["a"]; !ok {
+		t.Errorf("expected a to be reported")
+	}
+	c.recordHealth("a", true, now)
+	if !c.healthy("a", now) || len(c.GatewayHealth()) != 0 {
+		t.Errorf("expected success to reset the backoff")
+	}
+	tx := c.newTransaction(&hpsRequest{}, map[string]bool{"b": true}, false)
+	if tx.eligible("b", now) || !tx.eligible("a", now) {
+		t.Errorf("expected b to be skipped, it was tried already")
+	}
+	c.recordHealth("a", false, now)
+	if tx.eligible("a", now) {
+		t.Errorf("expected a to be skipped, it is backing off")
+	}
+	tx.retrying = true
+	if !tx.eligible("a", now) || tx.eligible("b", now) {
+		t.Errorf("expected retries to ignore the backoff")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ok := Response{NotifyStatus: NotifyStatus{StatusCode: http.StatusOK}}
+	unavailable := Response{NotifyStatus: NotifyStatus{StatusCode: http.StatusServiceUnavailable}}
+	badGateway := Response{NotifyStatus: NotifyStatus{StatusCode: http.StatusBadGateway}}
+	if failover(ok, nil) || !failover(unavailable, nil) || !failover(badGateway, nil) {
+		t.Errorf("status codes")
+	}
+	if !failover(Response{}, DisconnectedError) || !failover(Response{}, ConnectionTimeoutError) || failover(Response{}, HandshakeError) {
+		t.Errorf("errors")
+	}
+}
+
+func TestResend(t *testing.T) {
+	badGateway := Response{NotifyStatus: NotifyStatus{StatusCode: http.StatusBadGateway}}
+	if !failover(badGateway, nil) {
+		t.Fatalf("502 doesn't fail over")
+	}
+	keyed := http.Header{"Idempotency-Key": {"abc"}}
+	tests := []struct {
+		method string
+		h      http.Header
+		sent   bool
+		want   bool
+	}{
+		// A POST getting a 502 may have reached upstream
+		{"POST", http.Header{}, true, false},
+		{"POST", keyed, true, true},
+		{"GET", http.Header{}, true, true},
+		{"PUT", http.Header{}, true, true},
+		// Failed before the gateway was sent the request
+		{"POST", http.Header{}, false, true},
+	}
+	for _, tt := range tests {
+		if got := resend(tt.method, tt.h, tt.sent); got != tt.want {
+			t.Errorf("%s %v sent %t: got %t, want %t", tt.method, tt.h, tt.sent, got, tt.want)
+		}
+	}
+}
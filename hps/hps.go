@@ -5,6 +5,16 @@ const (
 	DeviceName   = "davidoram/HPS"
 	HpsServiceID = "0136bd82-ba81-48c6-b608-df7aa274338a"
 
+	// Extensions to the HPS spec, these live in the HPS service
+	KeyExchangeID = "0136bd83-ba81-48c6-b608-df7aa274338a"
+	// CapabilitiesID advertises the protocol version & the extensions
+	// supported, see Capabilities
+	CapabilitiesID = "0136bd84-ba81-48c6-b608-df7aa274338a"
+	// BodySegmentID streams response bodies longer than a single read:
+	// write the offset as a little endian uint32, then each read returns
+	// the next segment, until an empty one
+	BodySegmentID = "0136bd85-ba81-48c6-b608-df7aa274338a"
+
 	// From https://btprodspecificationrefs.blob.core.windows.net/assigned-values/16-bit%20UUID%20Numbers%20Document.pdf
 	HTTPURIID          = 0x2AB6
 	HTTPHeadersID      = 0x2AB7
@@ -14,6 +24,15 @@ const (
 	HTTPSSecurityID    = 0x2ABB
 	TDSControlPointID  = 0x2ABC
 
+	// Device Information Service, published alongside the HPS service
+	DeviceInformationID = 0x180A
+	ModelNumberID       = 0x2A24
+	SerialNumberID      = 0x2A25
+	FirmwareRevisionID  = 0x2A26
+	HardwareRevisionID  = 0x2A27
+	SoftwareRevisionID  = 0x2A28
+	ManufacturerNameID  = 0x2A29
+
 	HTTPReserved      uint8 = 0x00
 	HTTPGet           uint8 = 0x01
 	HTTPHead          uint8 = 0x02
@@ -9,12 +9,35 @@ import (
 // EncodeHeaders returns the HTTP Headers from the response, encoded into a
 // Byte buffer. The buffer will not exceed the maximum size of HeaderMaxOctets
 // Returns the buffer, along with a flag set true if the headers were truncated to fit the
-// buffer. Truncation occurs at the end of each Header
+// buffer. Truncation occurs at the end of each Header. The link headers are
+// encoded first, so they are never truncated.
 func EncodeHeaders(headers http.Header) ([]byte, bool) {
+	return encodeHeaders(headers, HeaderMaxOctets)
+}
+
+// FitHeaders returns encoded headers that fit in n octets, in the same
+// encoding, dropping whole headers. It reports whether any were dropped.
+func FitHeaders(b []byte, n int) ([]byte, bool) {
+	if len(b) <= n {
+		return b, false
+	}
+	if n <= 0 {
+		return []byte{}, true
+	}
+	if IsCompactHeaders(b) {
+		b, _ = encodeCompactHeaders(DecodeHeaders(b), n)
+	} else {
+		b, _ = encodeHeaders(DecodeHeaders(b), n)
+	}
+	return b, true
+}
+
+func encodeHeaders(headers http.Header, max int) ([]byte, bool) {
 	truncated := false
 	var b bytes.Buffer
 	idx := 0
-	for name, values := range headers {
+	for _, name := range headerNames(headers) {
+		values := headers[name]
 		var s strings.Builder
 		if idx > 0 {
 			s.WriteString("\n")
@@ -33,7 +56,7 @@ func EncodeHeaders(headers http.Header) ([]byte, bool) {
 		}
 
 		// Bail if we are going to exceed the maximum size
-		if s.Len()+b.Len() > HeaderMaxOctets {
+		if s.Len()+b.Len() > max {
 			truncated = true
 			break
 		}
@@ -42,12 +65,31 @@ func EncodeHeaders(headers http.Header) ([]byte, bool) {
 	return b.Bytes(), truncated
 }
 
-// DecodeHeaders decodes byte[] to http.Header
+// headerNames returns the names of the headers, the link headers first
+func headerNames(headers http.Header) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		switch http.CanonicalHeaderKey(name) {
+		case AcceptEncodingHeader, ContentEncodingHeader, HeaderEncodingHeader:
+			names = append([]string{name}, names...)
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// DecodeHeaders decodes byte[] to http.Header, in either the text or the
+// compact encoding
 func DecodeHeaders(b []byte) http.Header {
 	headers := http.Header{}
 	if len(b) == 0 {
 		return headers
 	}
+	if IsCompactHeaders(b) {
+		headers, _ = DecodeCompactHeaders(b)
+		return headers
+	}
 	raw := strings.Split(string(b), "\n")
 	for _, hdr := range raw {
 		// Split into "{key}={values}"
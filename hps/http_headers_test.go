@@ -45,3 +45,29 @@ func TestHeaderEncoding(t *testing.T) {
 
 	}
 }
+
+func TestFitHeaders(t *testing.T) {
+	h := http.Header{
+		"Content-Type":  {"text/plain"},
+		"Cache-Control": {"no-cache"},
+		"Etag":          {`"33a64df551425fcc55e4d42a148795d9f25f89d4"`},
+	}
+	for _, encode := range []func(http.Header) ([]byte, bool){EncodeHeaders, EncodeCompactHeaders} {
+		b, _ := encode(h)
+		if got, truncated := FitHeaders(b, len(b)); truncated || len(got) != len(b) {
+			t.Errorf("fits: got %q, truncated: %v", got, truncated)
+		}
+		got, truncated := FitHeaders(b, len(b)-1)
+		if !truncated || len(got) >= len(b) || IsCompactHeaders(got) != IsCompactHeaders(b) {
+			t.Errorf("truncated: got %q", got)
+		}
+		for name, values := range DecodeHeaders(got) {
+			if !reflect.DeepEqual(values, h[name]) {
+				t.Errorf("%s: got %v, want whole headers", name, values)
+			}
+		}
+		if got, _ := FitHeaders(b, 0); len(got) != 0 {
+			t.Errorf("no room: got %q", got)
+		}
+	}
+}
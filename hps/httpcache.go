@@ -0,0 +1,421 @@
+package hps
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a response held in an HTTP cache, following the
+// caching semantics of RFC 7234
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// Stored is when the response was received, or last revalidated
+	Stored time.Time
+
+	// Vary holds the request header values the response was selected by
+	Vary map[string]string
+}
+
+// CacheKey identifies a cached response
+func CacheKey(method, url string) string {
+	return method + " " + url
+}
+
+// CacheControl returns the Cache-Control directives in h, the values of
+// directives without an argument are empty
+func CacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			kv := strings.SplitN(d, "=", 2)
+			name := strings.ToLower(strings.TrimSpace(kv[0]))
+			if len(kv) == 2 {
+				cc[name] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			} else {
+				cc[name] = ""
+			}
+		}
+	}
+	return cc
+}
+
+func seconds(cc map[string]string, directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// Cacheable reports whether a response may be stored. A shared cache, such
+// as the one in the peripheral, must not store private responses.
+func Cacheable(method string, reqHeader http.Header, statusCode int, respHeader http.Header, shared bool) bool {
+	if method != http.MethodGet {
+		return false
+	}
+	switch statusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusNotFound,
+		http.StatusMethodNotAllowed, http.StatusGone, http.StatusNotImplemented:
+	default:
+		return false
+	}
+	if _, ok := CacheControl(reqHeader)["no-store"]; ok {
+		return false
+	}
+	cc := CacheControl(respHeader)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if strings.TrimSpace(respHeader.Get("Vary")) == "*" {
+		return false
+	}
+	if shared {
+		if _, ok := cc["private"]; ok {
+			return false
+		}
+		if reqHeader.Get("Authorization") != "" {
+			_, public := cc["public"]
+			_, smaxage := cc["s-maxage"]
+			_, revalidate := cc["must-revalidate"]
+			if !public && !smaxage && !revalidate {
+				return false
+			}
+		}
+	}
+	// Only store responses that can be reused or revalidated
+	if _, ok := freshnessLifetime(respHeader, shared); ok {
+		return true
+	}
+	return respHeader.Get("ETag") != "" || respHeader.Get("Last-Modified") != ""
+}
+
+// NewCachedResponse prepares a response for storage
+func NewCachedResponse(reqHeader http.Header, statusCode int, respHeader http.Header, body []byte, now time.Time) *CachedResponse {
+	c := &CachedResponse{
+		StatusCode: statusCode,
+		Header:     respHeader.Clone(),
+		Body:       body,
+		Stored:     now,
+		Vary:       map[string]string{},
+	}
+	for _, v := range respHeader.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				c.Vary[name] = strings.Join(reqHeader.Values(name), ", ")
+			}
+		}
+	}
+	return c
+}
+
+// Matches reports whether the cached response was selected by the same
+// request headers, see the Vary header
+func (c *CachedResponse) Matches(reqHeader http.Header) bool {
+	for name, value := range c.Vary {
+		if strings.Join(reqHeader.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// freshnessLifetime is how long a response is fresh for after it was
+// generated, from s-maxage (shared caches only), max-age or Expires
+func freshnessLifetime(h http.Header, shared bool) (time.Duration, bool) {
+	cc := CacheControl(h)
+	if shared {
+		if d, ok := seconds(cc, "s-maxage"); ok {
+			return d, true
+		}
+	}
+	if d, ok := seconds(cc, "max-age"); ok {
+		return d, true
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// Invalid dates, such as "0", mean already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			return 0, false
+		}
+		if d := expires.Sub(date); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Age is the time since the response was generated by the origin
+func (c *CachedResponse) Age(now time.Time) time.Duration {
+	age := now.Sub(c.Stored)
+	if age < 0 {
+		age = 0
+	}
+	if n, err := strconv.ParseInt(c.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		age += time.Duration(n) * time.Second
+	}
+	return age
+}
+
+// Fresh reports whether the response can be served without contacting the
+// origin, taking the request's Cache-Control directives into account
+func (c *CachedResponse) Fresh(reqHeader http.Header, now time.Time, shared bool) bool {
+	rcc := CacheControl(reqHeader)
+	if _, ok := rcc["no-cache"]; ok {
+		return false
+	}
+	if _, ok := CacheControl(c.Header)["no-cache"]; ok {
+		return false
+	}
+	lifetime, ok := freshnessLifetime(c.Header, shared)
+	if !ok {
+		return false
+	}
+	age := c.Age(now)
+	if maxAge, ok := seconds(rcc, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := seconds(rcc, "min-fresh"); ok {
+		age += minFresh
+	}
+	return age < lifetime
+}
+
+// StaleIfError reports whether the stale response may be served because the
+// origin could not be reached, see RFC 5861
+func (c *CachedResponse) StaleIfError(reqHeader http.Header, now time.Time, shared bool) bool {
+	cc := CacheControl(c.Header)
+	if _, ok := cc["must-revalidate"]; ok {
+		return false
+	}
+	if _, ok := cc["proxy-revalidate"]; ok && shared {
+		return false
+	}
+	window, ok := seconds(CacheControl(reqHeader), "stale-if-error")
+	if !ok {
+		window, ok = seconds(cc, "stale-if-error")
+	}
+	if !ok {
+		return false
+	}
+	lifetime, _ := freshnessLifetime(c.Header, shared)
+	return c.Age(now) < lifetime+window
+}
+
+// Revalidate adds the conditional request headers, so the origin can
+// reply 304 Not Modified if the cached response is still current
+func (c *CachedResponse) Revalidate(reqHeader http.Header) {
+	if etag := c.Header.Get("ETag"); etag != "" {
+		reqHeader.Set("If-None-Match", etag)
+	}
+	if lm := c.Header.Get("Last-Modified"); lm != "" {
+		reqHeader.Set("If-Modified-Since", lm)
+	}
+}
+
+// Refresh returns a copy of the cached response, updated from a 304 Not
+// Modified response
+func (c *CachedResponse) Refresh(respHeader http.Header, now time.Time) *CachedResponse {
+	r := *c
+	r.Header = c.Header.Clone()
+	for name, values := range respHeader {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		r.Header[name] = values
+	}
+	r.Stored = now
+	return &r
+}
+
+func (c *CachedResponse) size() int64 {
+	n := int64(len(c.Body))
+	for name, values := range c.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// CacheStore holds cached responses, see MemoryCache and DiskCache
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, r *CachedResponse)
+	Delete(key string)
+	Flush()
+}
+
+// MemoryCache holds cached responses in memory, evicting the least
+// recently used once the total size exceeds MaxBytes
+type MemoryCache struct {
+	MaxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key  string
+	r    *CachedResponse
+	size int64
+}
+
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{MaxBytes: maxBytes, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (m *MemoryCache) Get(key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(e)
+	return e.Value.(*memoryCacheEntry).r, true
+}
+
+func (m *MemoryCache) Set(key string, r *CachedResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delete(key)
+	size := r.size()
+	if size > m.MaxBytes {
+		return
+	}
+	m.entries[key] = m.lru.PushFront(&memoryCacheEntry{key: key, r: r, size: size})
+	m.size += size
+	for m.size > m.MaxBytes {
+		m.delete(m.lru.Back().Value.(*memoryCacheEntry).key)
+	}
+}
+
+func (m *MemoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delete(key)
+}
+
+func (m *MemoryCache) delete(key string) {
+	if e, ok := m.entries[key]; ok {
+		m.lru.Remove(e)
+		delete(m.entries, key)
+		m.size -= e.Value.(*memoryCacheEntry).size
+	}
+}
+
+// Flush removes every cached response
+func (m *MemoryCache) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Init()
+	m.entries = map[string]*list.Element{}
+	m.size = 0
+}
+
+// Len returns the number of cached responses
+func (m *MemoryCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// DiskCache holds cached responses as files in Dir, so they survive restarts
+type DiskCache struct {
+	Dir string
+}
+
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskCache{Dir: dir}, nil
+}
+
+func (d *DiskCache) path(key string) string {
+	return filepath.Join(d.Dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+func (d *DiskCache) Get(key string) (*CachedResponse, bool) {
+	b, err := ioutil.ReadFile(d.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var r CachedResponse
+	if err := json.Unmarshal(b, &r); err != nil {
+		log.Printf("Warn: discarding corrupt cache entry %s, err: %v", key, err)
+		d.Delete(key)
+		return nil, false
+	}
+	return &r, true
+}
+
+func (d *DiskCache) Set(key string, r *CachedResponse) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Warn: unable to cache %s, err: %v", key, err)
+		return
+	}
+	// Write then rename, so readers never see a partial entry
+	f, err := ioutil.TempFile(d.Dir, "tmp-")
+	if err != nil {
+		log.Printf("Warn: unable to cache %s, err: %v", key, err)
+		return
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), d.path(key))
+	}
+	if err != nil {
+		log.Printf("Warn: unable to cache %s, err: %v", key, err)
+		os.Remove(f.Name())
+	}
+}
+
+func (d *DiskCache) Delete(key string) {
+	os.Remove(d.path(key))
+}
+
+// Flush removes every cached response
+func (d *DiskCache) Flush() {
+	files, _ := filepath.Glob(filepath.Join(d.Dir, "*.json"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
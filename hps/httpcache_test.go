@@ -0,0 +1,189 @@
+package hps
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+var freshnessTests = []struct {
+	reqHeader  http.Header
+	respHeader http.Header
+	age        time.Duration
+	shared     bool
+	cacheable  bool
+	fresh      bool
+	staleOk    bool
+}{
+	{
+		http.Header{},
+		http.Header{"Cache-Control": {"max-age=60"}},
+		time.Second * 30, true, true, true, false,
+	},
+	{
+		http.Header{},
+		http.Header{"Cache-Control": {"max-age=60"}},
+		time.Second * 90, true, true, false, false,
+	},
+	{
+		http.Header{},
+		http.Header{"Cache-Control": {"max-age=60, stale-if-error=60"}},
+		time.Second * 90, true, true, false, true,
+	},
+	{
+		http.Header{},
+		http.Header{"Cache-Control": {"max-age=60, stale-if-error=60, must-revalidate"}},
+		time.Second * 90, true, true, false, false,
+	},
+	{
+		http.Header{},
+		http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}},
+		time.Second * 30, true, true, false, false,
+	},
+	{
+		http.Header{},
+		http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}},
+		time.Second * 30, false, true, true, false,
+	},
+	{
+		http.Header{"Cache-Control": {"no-cache"}},
+		http.Header{"Cache-Control": {"max-age=60"}},
+		time.Second * 30, true, true, false, false,
+	},
+	{
+		http.Header{"Cache-Control": {"no-store"}},
+		http.Header{"Cache-Control": {"max-age=60"}},
+		0, true, false, true, false,
+	},
+	{
+		http.Header{},
+		http.Header{"Cache-Control": {"private, max-age=60"}},
+		0, true, false, true, false,
+	},
+	{
+		http.Header{"Authorization": {"Bearer xyz"}},
+		http.Header{"Cache-Control": {"max-age=60"}},
+		0, true, false, true, false,
+	},
+	{
+		http.Header{"Authorization": {"Bearer xyz"}},
+		http.Header{"Cache-Control": {"public, max-age=60"}},
+		0, true, true, true, false,
+	},
+	{
+		http.Header{},
+		http.Header{
+			"Date":    {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			"Expires": {"Mon, 02 Jan 2006 15:05:05 GMT"},
+		},
+		time.Second * 30, true, true, true, false,
+	},
+	{
+		http.Header{},
+		http.Header{"Expires": {"0"}},
+		0, true, true, false, false,
+	},
+	{
+		http.Header{},
+		http.Header{"Etag": {`"abc"`}},
+		0, true, true, false, false,
+	},
+	{
+		http.Header{},
+		http.Header{},
+		0, true, false, false, false,
+	},
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Now()
+	for i, tt := range freshnessTests {
+		if got := Cacheable(http.MethodGet, tt.reqHeader, http.StatusOK, tt.respHeader, tt.shared); got != tt.cacheable {
+			t.Errorf("%d cacheable: got %t, want %t", i, got, tt.cacheable)
+		}
+		c := NewCachedResponse(tt.reqHeader, http.StatusOK, tt.respHeader, nil, now.Add(-tt.age))
+		if got := c.Fresh(tt.reqHeader, now, tt.shared); got != tt.fresh {
+			t.Errorf("%d fresh: got %t, want %t", i, got, tt.fresh)
+		}
+		if got := c.StaleIfError(tt.reqHeader, now, tt.shared); got != tt.staleOk {
+			t.Errorf("%d stale-if-error: got %t, want %t", i, got, tt.staleOk)
+		}
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	c := NewCachedResponse(http.Header{"Accept": {"text/plain"}}, http.StatusOK, http.Header{
+		"Etag":          {`"abc"`},
+		"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"},
+		"Vary":          {"Accept"},
+	}, []byte("hi"), time.Now())
+
+	if !c.Matches(http.Header{"Accept": {"text/plain"}}) {
+		t.Errorf("got no match, want match")
+	}
+	if c.Matches(http.Header{"Accept": {"application/json"}}) {
+		t.Errorf("got match, want no match")
+	}
+
+	h := http.Header{}
+	c.Revalidate(h)
+	if h.Get("If-None-Match") != `"abc"` || h.Get("If-Modified-Since") != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Errorf("got %v, want conditional headers", h)
+	}
+
+	r := c.Refresh(http.Header{"Cache-Control": {"max-age=60"}}, time.Now())
+	if !r.Fresh(http.Header{}, time.Now(), true) {
+		t.Errorf("got stale after refresh, want fresh")
+	}
+	if c.Header.Get("Cache-Control") != "" {
+		t.Errorf("refresh modified the original")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	m := NewMemoryCache(10)
+	m.Set("a", &CachedResponse{Header: http.Header{}, Body: []byte("12345")})
+	m.Set("b", &CachedResponse{Header: http.Header{}, Body: []byte("12345")})
+	m.Get("a")
+	m.Set("c", &CachedResponse{Header: http.Header{}, Body: []byte("12345")})
+	if _, ok := m.Get("b"); ok {
+		t.Errorf("got b, want it evicted")
+	}
+	if _, ok := m.Get("a"); !ok {
+		t.Errorf("got a evicted, want it kept")
+	}
+	m.Set("d", &CachedResponse{Header: http.Header{}, Body: []byte("12345678901")})
+	if _, ok := m.Get("d"); ok {
+		t.Errorf("got d, want it too large to cache")
+	}
+	m.Flush()
+	if m.Len() != 0 {
+		t.Errorf("got %d entries, want 0", m.Len())
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	d, err := NewDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := CacheKey(http.MethodGet, "http://localhost:8100/hello.txt")
+	want := NewCachedResponse(http.Header{}, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, []byte("hi"), time.Now())
+	d.Set(key, want)
+
+	got, ok := d.Get(key)
+	if !ok {
+		t.Fatalf("got miss, want hit")
+	}
+	if got.StatusCode != want.StatusCode || string(got.Body) != string(want.Body) || !got.Stored.Equal(want.Stored) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !got.Fresh(http.Header{}, time.Now(), false) {
+		t.Errorf("got stale, want fresh")
+	}
+
+	d.Flush()
+	if _, ok := d.Get(key); ok {
+		t.Errorf("got hit after flush, want miss")
+	}
+}
@@ -0,0 +1,138 @@
+package hps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// RequestTooLargeError is returned when a request's headers or body don't
+// fit in the HPS characteristics, see HeaderMaxOctets & BodyMaxOctets
+var RequestTooLargeError = errors.New("Request headers or body too large")
+
+// HTTPResponse is the response to a request made with Client.Do
+type HTTPResponse struct {
+	Status     string // eg: "200 OK"
+	StatusCode int    // eg: 200
+	Header     http.Header
+
+	// Body is the response body, the caller must close it. Bodies longer
+	// than a single read are streamed from the gateway as they are read,
+	// if it supports it, holding the connection until closed.
+	// ContentLength is -1 if the length of a streamed body is unknown.
+	Body          io.ReadCloser
+	ContentLength int64
+
+	// HeadersTruncated & BodyTruncated are set when the gateway couldn't
+	// fit all of the upstream response in the HPS characteristics, and
+	// didn't stream it
+	HeadersTruncated bool
+	BodyTruncated    bool
+
+	// FromCache is set when the response was served from the client's cache
+	FromCache bool
+
+	// Request is the request that was sent
+	Request *http.Request
+}
+
+// Do makes an HTTP request through the gateway. The request's URL may be
+// absolute, or a logical URI for the gateway's route table, eg:
+// '/telemetry'. Its context cancels the request, including scanning,
+// retries & failover.
+//
+// A 502, 503 or 504 from the gateway is returned with an UpstreamError,
+// other errors are returned without a response. The body is closed, even on
+// errors.
+func (client *Client) Do(req *http.Request) (*HTTPResponse, error) {
+	uri, method, headers, body, err := encodeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.send(req.Context(), uri, body, method, headers, true)
+	var upstreamErr *UpstreamError
+	if err != nil && !(errors.As(err, &upstreamErr) && upstreamErr.StatusCode != 0) {
+		return nil, err
+	}
+	return newHTTPResponse(req, r), err
+}
+
+// encodeRequest returns the HPS values for a request
+func encodeRequest(req *http.Request) (uri, method string, headers ArrayStr, body string, err error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if req.URL == nil {
+		return "", "", nil, "", errors.New("Request has no URL")
+	}
+	method = req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	h, truncated := EncodeHeaders(req.Header)
+	if truncated {
+		return "", "", nil, "", fmt.Errorf("%w: headers over %d octets", RequestTooLargeError, HeaderMaxOctets)
+	}
+	if len(h) > 0 {
+		headers = strings.Split(string(h), "\n")
+	}
+
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(BodyMaxOctets)+1))
+		if err != nil {
+			return "", "", nil, "", err
+		}
+		if len(b) > BodyMaxOctets {
+			return "", "", nil, "", fmt.Errorf("%w: body over %d octets", RequestTooLargeError, BodyMaxOctets)
+		}
+		body = string(b)
+	}
+	return req.URL.String(), method, headers, body, nil
+}
+
+// encodeLinkRequest encodes the request headers & body for the peripheral,
+// with the link extensions in features. It returns the headers value, the
+// headers including the link headers, and the body. The headers must fit in
+// HeaderMaxOctets once encoded.
+func encodeLinkRequest(headers ArrayStr, body []byte, features Feature) ([]byte, ArrayStr, []byte, error) {
+	if encodings := bodyEncodings(features); encodings != "" {
+		headers = append(append(ArrayStr{}, headers...), AcceptEncodingHeader+"="+encodings)
+		headers, body = encodeRequestBody(encodings, headers, body)
+	}
+	hb, truncated := []byte(headers.String()), false
+	if features&FeatureCompactHeaders != 0 {
+		headers = append(append(ArrayStr{}, headers...), HeaderEncodingHeader+"="+CompactHeaderEncoding)
+		hb, truncated = EncodeCompactHeaders(headers.Header())
+	}
+	if truncated || len(hb) > HeaderMaxOctets {
+		return nil, nil, nil, fmt.Errorf("%w: headers over %d octets", RequestTooLargeError, HeaderMaxOctets)
+	}
+	return hb, headers, body, nil
+}
+
+func newHTTPResponse(req *http.Request, r Response) *HTTPResponse {
+	h := r.DecodedHeaders()
+	var body io.ReadCloser = ioutil.NopCloser(bytes.NewReader(r.Body))
+	if r.stream != nil {
+		body = streamedBody{Reader: io.MultiReader(bytes.NewReader(r.Body), r.stream), stream: r.stream}
+		if r.encoding != "" {
+			body = &decodingBody{encoding: r.encoding, r: body, closer: body}
+		}
+	}
+	return &HTTPResponse{
+		Status:           fmt.Sprintf("%d %s", r.NotifyStatus.StatusCode, http.StatusText(r.NotifyStatus.StatusCode)),
+		StatusCode:       r.NotifyStatus.StatusCode,
+		Header:           h,
+		Body:             body,
+		ContentLength:    contentLength(r, h),
+		HeadersTruncated: r.NotifyStatus.HeadersTruncated,
+		BodyTruncated:    r.NotifyStatus.BodyTruncated && r.stream == nil,
+		FromCache:        r.FromCache,
+		Request:          req,
+	}
+}
@@ -0,0 +1,89 @@
+package hps
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRequest(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPut, "http://localhost:8100/lamp", strings.NewReader(`{"on":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	uri, method, headers, body, err := encodeRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != "http://localhost:8100/lamp" || method != http.MethodPut || body != `{"on":true}` {
+		t.Errorf("got %s %s %q", method, uri, body)
+	}
+	if got := headers.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type: got %q", got)
+	}
+
+	req, _ = http.NewRequest("", "/telemetry", nil)
+	uri, method, headers, body, err = encodeRequest(req)
+	if err != nil || uri != "/telemetry" || method != http.MethodGet || len(headers) != 0 || body != "" {
+		t.Errorf("got %s %s %v %q, err: %v", method, uri, headers, body, err)
+	}
+}
+
+func TestEncodeRequestTooLarge(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:8100/", strings.NewReader(strings.Repeat("a", BodyMaxOctets+1)))
+	if _, _, _, _, err := encodeRequest(req); !errors.Is(err, RequestTooLargeError) {
+		t.Errorf("body: got %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost:8100/", nil)
+	req.Header.Set("X-Large", strings.Repeat("a", HeaderMaxOctets))
+	if _, _, _, _, err := encodeRequest(req); !errors.Is(err, RequestTooLargeError) {
+		t.Errorf("headers: got %v", err)
+	}
+}
+
+func TestEncodeLinkRequestTooLarge(t *testing.T) {
+	// Fits on its own, but not once the link headers are added
+	headers := ArrayStr{"X-Large=" + strings.Repeat("a", HeaderMaxOctets-len("X-Large="))}
+	if _, _, _, err := encodeLinkRequest(headers, nil, 0); err != nil {
+		t.Errorf("plain: got %v", err)
+	}
+	if _, _, _, err := encodeLinkRequest(headers, nil, FeatureGzip); !errors.Is(err, RequestTooLargeError) {
+		t.Errorf("text: got %v", err)
+	}
+	if _, _, _, err := encodeLinkRequest(headers, nil, FeatureCompactHeaders); !errors.Is(err, RequestTooLargeError) {
+		t.Errorf("compact: got %v", err)
+	}
+
+	// Raw headers are checked as given
+	headers = ArrayStr{"X-Large=" + strings.Repeat("a", HeaderMaxOctets)}
+	if _, _, _, err := encodeLinkRequest(headers, nil, 0); !errors.Is(err, RequestTooLargeError) {
+		t.Errorf("raw: got %v", err)
+	}
+
+	hb, h, _, err := encodeLinkRequest(ArrayStr{"Accept=*/*"}, nil, FeatureCompactHeaders|FeatureGzip)
+	if err != nil || !IsCompactHeaders(hb) || h.Header().Get(HeaderEncodingHeader) != CompactHeaderEncoding {
+		t.Errorf("compact: got %x %v, err: %v", hb, h, err)
+	}
+}
+
+func TestNewHTTPResponse(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8100/hello.txt", nil)
+	resp := newHTTPResponse(req, Response{
+		NotifyStatus: NotifyStatus{StatusCode: http.StatusOK, HeadersReceived: true, BodyReceived: true, BodyTruncated: true},
+		Headers:      []byte("Content-Type=text/plain\nEtag=\"abc\""),
+		Body:         []byte("hello"),
+	})
+	if resp.Status != "200 OK" || resp.StatusCode != http.StatusOK || !resp.BodyTruncated || resp.HeadersTruncated || resp.Request != req {
+		t.Errorf("got %+v", resp)
+	}
+	if resp.Header.Get("Content-Type") != "text/plain" || resp.Header.Get("Etag") != `"abc"` {
+		t.Errorf("headers: got %v", resp.Header)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(b) != "hello" || resp.ContentLength != 5 {
+		t.Errorf("body: got %q, err: %v", b, err)
+	}
+}
@@ -7,6 +7,25 @@ type Response struct {
 	Headers      []byte
 	Body         []byte
 	Notified     bool
+
+	// FromCache is set when the response was served from the client's cache
+	FromCache bool
+
+	// stream reads the rest of the body, when it is streamed, see Client.Do
+	stream *bodyStream
+
+	// encoding is the link encoding of a streamed body, which is
+	// decompressed as it is read, see decodeResponse
+	encoding string
+}
+
+// closeBody closes the body stream, if there is one, when the response is
+// discarded
+func (r *Response) closeBody() {
+	if r.stream != nil {
+		r.stream.Close()
+		r.stream = nil
+	}
 }
 
 func (r *Response) DecodedHeaders() http.Header {
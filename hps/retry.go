@@ -0,0 +1,123 @@
+package hps
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy retries requests that fail with a transient error, backing off
+// exponentially between attempts. The zero value makes a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the most attempts to make, including the first
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, it is multiplied by
+	// Multiplier for each retry after that, up to MaxBackoff. Jitter
+	// randomises each wait by up to that fraction of it, so that centrals
+	// failing together don't retry together.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+
+	// Retryable reports whether an attempt should be retried, it defaults to
+	// Retryable. A POST is only retried if it has an idempotency key, see
+	// Idempotent.
+	Retryable func(r Response, err error) bool
+}
+
+// DefaultRetryPolicy makes up to 3 attempts, backing off from 250ms
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond * 250,
+	MaxBackoff:     time.Second * 10,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// Retryable reports whether a request failed with an error worth retrying:
+// a connection timeout, a ConnectError such as a disconnect, an ATTError, or
+// an UpstreamError such as a 502, 503 or 504 status
+func Retryable(r Response, err error) bool {
+	if err != nil {
+		var connectErr *ConnectError
+		var attErr *ATTError
+		var upstreamErr *UpstreamError
+		return errors.Is(err, ConnectionTimeoutError) || errors.Is(err, DisconnectedError) ||
+			errors.As(err, &connectErr) || errors.As(err, &attErr) || errors.As(err, &upstreamErr)
+	}
+	switch r.NotifyStatus.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Idempotent reports whether a request can safely be sent again. POST is
+// only idempotent with an 'Idempotency-Key' or 'X-Idempotency-Key' header,
+// as with net/http.
+func Idempotent(method string, h http.Header) bool {
+	if strings.ToUpper(strings.TrimSpace(method)) != http.MethodPost {
+		return true
+	}
+	_, ok := h["Idempotency-Key"]
+	if !ok {
+		_, ok = h["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// retry reports whether to make another attempt, after attempt number
+// attempt, counting from 0, failed
+func (p RetryPolicy) retry(attempt int, method string, h http.Header, r Response, err error) bool {
+	if attempt+1 >= p.MaxAttempts || !Idempotent(method, h) {
+		return false
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = Retryable
+	}
+	return retryable(r, err)
+}
+
+// backoff is the wait before retry number n, counting from 0. rnd returns a
+// number in [0, 1) for the jitter.
+func (p RetryPolicy) backoff(n int, rnd func() float64) time.Duration {
+	d := float64(p.InitialBackoff)
+	if d <= 0 {
+		d = float64(DefaultRetryPolicy.InitialBackoff)
+	}
+	max := float64(p.MaxBackoff)
+	if max <= 0 {
+		max = float64(DefaultRetryPolicy.MaxBackoff)
+	}
+	m := p.Multiplier
+	if m < 1 {
+		m = DefaultRetryPolicy.Multiplier
+	}
+	for i := 0; i < n && d < max; i++ {
+		d *= m
+	}
+	if d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rnd() - 1)
+	}
+	return time.Duration(d)
+}
+
+var jitter = struct {
+	sync.Mutex
+	r *rand.Rand
+}{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func jitterFloat64() float64 {
+	jitter.Lock()
+	defer jitter.Unlock()
+	return jitter.r.Float64()
+}
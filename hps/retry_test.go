@@ -0,0 +1,79 @@
+package hps
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func statusResponse(code int) Response {
+	return Response{NotifyStatus: NotifyStatus{StatusCode: code}}
+}
+
+var retryTests = []struct {
+	attempt int
+	method  string
+	header  http.Header
+	r       Response
+	err     error
+	want    bool
+}{
+	{0, http.MethodGet, nil, Response{}, ConnectionTimeoutError, true},
+	{0, http.MethodGet, nil, Response{}, DisconnectedError, true},
+	{0, http.MethodGet, nil, Response{}, &ATTError{Op: "write", Err: errors.New("rejected")}, true},
+	{0, http.MethodGet, nil, Response{}, fmt.Errorf("wrapped: %w", DisconnectedError), true},
+	{0, http.MethodGet, nil, Response{}, UnknownError, false},
+	{0, http.MethodGet, nil, statusResponse(http.StatusServiceUnavailable), nil, true},
+	{0, http.MethodGet, nil, statusResponse(http.StatusGatewayTimeout), nil, true},
+	{0, http.MethodGet, nil, statusResponse(http.StatusInternalServerError), nil, false},
+	{0, http.MethodGet, nil, statusResponse(http.StatusOK), nil, false},
+	{1, http.MethodGet, nil, Response{}, DisconnectedError, true},
+	{2, http.MethodGet, nil, Response{}, DisconnectedError, false},
+	{0, http.MethodPut, nil, Response{}, DisconnectedError, true},
+	{0, http.MethodPost, nil, Response{}, DisconnectedError, false},
+	{0, "post", nil, Response{}, DisconnectedError, false},
+	{0, http.MethodPost, http.Header{"Idempotency-Key": {"abc"}}, Response{}, DisconnectedError, true},
+	{0, http.MethodPost, http.Header{"X-Idempotency-Key": {"abc"}}, Response{}, DisconnectedError, true},
+}
+
+func TestRetry(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3}
+	for _, tt := range retryTests {
+		if got := p.retry(tt.attempt, tt.method, tt.header, tt.r, tt.err); got != tt.want {
+			t.Errorf("retry(%d, %s, %v, %d, %v): got %t, want %t", tt.attempt, tt.method, tt.header, tt.r.NotifyStatus.StatusCode, tt.err, got, tt.want)
+		}
+	}
+	if (RetryPolicy{}).retry(0, http.MethodGet, nil, Response{}, DisconnectedError) {
+		t.Errorf("zero policy retried")
+	}
+	p.Retryable = func(Response, error) bool { return false }
+	if p.retry(0, http.MethodGet, nil, Response{}, DisconnectedError) {
+		t.Errorf("retried, despite Retryable")
+	}
+}
+
+var backoffTests = []struct {
+	n    int
+	rnd  float64
+	want time.Duration
+}{
+	{0, 0.5, time.Millisecond * 100},
+	{1, 0.5, time.Millisecond * 200},
+	{2, 0.5, time.Millisecond * 400},
+	{5, 0.5, time.Second},
+	{100, 0.5, time.Second},
+	{0, 0, time.Millisecond * 90},
+	{1, 1, time.Millisecond * 220},
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Millisecond * 100, MaxBackoff: time.Second, Multiplier: 2, Jitter: 0.1}
+	for _, tt := range backoffTests {
+		got := p.backoff(tt.n, func() float64 { return tt.rnd })
+		if got != tt.want {
+			t.Errorf("backoff(%d) with rnd %v: got %v, want %v", tt.n, tt.rnd, got, tt.want)
+		}
+	}
+}
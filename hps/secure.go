@@ -0,0 +1,219 @@
+package hps
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/paypal/gatt"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The encrypted mode runs an ephemeral X25519 key exchange over the
+// KeyExchangeID characteristic, then seals every characteristic value with
+// AES-256-GCM. An optional pre-shared key is mixed into the key derivation
+// so that both ends must know it, which stops an active man-in-the-middle.
+//
+// Handshake:
+//
+//	central    -> write KeyExchange: client public key (32 octets)
+//	peripheral -> read KeyExchange:  server public key (32 octets) ||
+//	                                 Seal(KeyExchange, keyConfirmation)
+//
+// Each sealed value is nonce (12 octets) || ciphertext || tag (16 octets).
+// The nonce is 4 zero octets then a big-endian counter, counting the values
+// sealed in that direction from 1. As with Noise transport messages, a value
+// whose counter is not higher than the last one opened for its
+// characteristic is rejected, so a captured value cannot be replayed. The
+// characteristic UUID is bound in as additional data, so a value cannot be
+// replayed against a different characteristic either.
+
+const (
+	// PublicKeyOctets is the size of an X25519 public key
+	PublicKeyOctets = 32
+
+	// SealOverhead is the number of octets Seal adds to each value
+	SealOverhead = 12 + 16
+)
+
+var (
+	HandshakeError = errors.New("Encryption handshake failed")
+	DecryptError   = errors.New("Unable to decrypt characteristic value")
+	ReplayError    = errors.New("Characteristic value replayed")
+)
+
+var keyConfirmation = []byte("hps-ok")
+
+// KeyPair is an ephemeral key pair used for a single handshake
+type KeyPair struct {
+	priv []byte
+	pub  []byte
+}
+
+func GenerateKeyPair() (*KeyPair, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{priv: priv, pub: pub}, nil
+}
+
+// PublicKey returns the public half of the key pair, as sent over the air
+func (k *KeyPair) PublicKey() []byte {
+	return k.pub
+}
+
+// Session holds the keys for one encrypted link, one per direction, and
+// the nonce counters
+type Session struct {
+	send cipher.AEAD
+	recv cipher.AEAD
+
+	mu     sync.Mutex
+	sent   uint64            // counter of the last value sealed
+	opened map[string]uint64 // counter of the last value opened, by characteristic
+}
+
+// NewSession derives a Session from our key pair and the peer's public key.
+// The initiator is the central, it decides which direction key is used for
+// sending. psk may be nil.
+func NewSession(k *KeyPair, peer []byte, psk []byte, initiator bool) (*Session, error) {
+	if len(peer) != PublicKeyOctets {
+		return nil, HandshakeError
+	}
+	// Fails on low order points, which give an all zero shared secret
+	shared, err := curve25519.X25519(k.priv, peer)
+	if err != nil {
+		return nil, HandshakeError
+	}
+
+	// Bind both public keys into the derived keys, client key first
+	var info bytes.Buffer
+	info.WriteString("hps v2")
+	if initiator {
+		info.Write(k.PublicKey())
+		info.Write(peer)
+	} else {
+		info.Write(peer)
+		info.Write(k.PublicKey())
+	}
+	okm := hkdf(psk, shared, info.Bytes(), 64)
+
+	c2s, err := newAEAD(okm[:32])
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newAEAD(okm[32:])
+	if err != nil {
+		return nil, err
+	}
+	if initiator {
+		return &Session{send: c2s, recv: s2c, opened: map[string]uint64{}}, nil
+	}
+	return &Session{send: s2c, recv: c2s, opened: map[string]uint64{}}, nil
+}
+
+// Seal encrypts the value written to, or read from, characteristic u
+func (s *Session) Seal(u gatt.UUID, b []byte) []byte {
+	s.mu.Lock()
+	s.sent++
+	counter := s.sent
+	s.mu.Unlock()
+	if counter == 0 {
+		// 2^64 values, never reached on a BLE link
+		panic("hps: nonce counter exhausted")
+	}
+
+	nonce := make([]byte, s.send.NonceSize(), s.send.NonceSize()+len(b)+s.send.Overhead())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return s.send.Seal(nonce, nonce, b, []byte(u.String()))
+}
+
+// Open decrypts a value sealed by the peer for characteristic u. It fails
+// with ReplayError if the value has been opened before, or is older than
+// one that has.
+func (s *Session) Open(u gatt.UUID, b []byte) ([]byte, error) {
+	n := s.recv.NonceSize()
+	if len(b) < n+s.recv.Overhead() {
+		return nil, DecryptError
+	}
+	p, err := s.recv.Open(nil, b[:n], b[n:], []byte(u.String()))
+	if err != nil {
+		return nil, DecryptError
+	}
+
+	// Authenticated, so the counter is the one the peer sealed
+	counter := binary.BigEndian.Uint64(b[n-8 : n])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if counter <= s.opened[u.String()] {
+		return nil, ReplayError
+	}
+	s.opened[u.String()] = counter
+	return p, nil
+}
+
+// EncodeHandshakeReply returns the value the peripheral serves from the
+// KeyExchangeID characteristic once it has derived its session
+func EncodeHandshakeReply(k *KeyPair, s *Session) []byte {
+	b := append([]byte{}, k.PublicKey()...)
+	return append(b, s.Seal(gatt.MustParseUUID(KeyExchangeID), keyConfirmation)...)
+}
+
+// DecodeHandshakeReply completes the handshake on the central. It fails
+// with HandshakeError if the peripheral derived different keys, for example
+// because the pre-shared keys differ.
+func DecodeHandshakeReply(k *KeyPair, b []byte, psk []byte) (*Session, error) {
+	if len(b) < PublicKeyOctets+SealOverhead {
+		return nil, HandshakeError
+	}
+	s, err := NewSession(k, b[:PublicKeyOctets], psk, true)
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := s.Open(gatt.MustParseUUID(KeyExchangeID), b[PublicKeyOctets:])
+	if err != nil || !bytes.Equal(confirm, keyConfirmation) {
+		return nil, HandshakeError
+	}
+	return s, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdf implements RFC 5869 with SHA-256
+func hkdf(salt, ikm, info []byte, n int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	var okm, t []byte
+	for i := byte(1); len(okm) < n; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(t)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		t = expand.Sum(nil)
+		okm = append(okm, t...)
+	}
+	return okm[:n]
+}
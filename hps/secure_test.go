@@ -0,0 +1,109 @@
+package hps
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/paypal/gatt"
+)
+
+var handshakeTests = []struct {
+	clientPSK []byte
+	serverPSK []byte
+	ok        bool
+}{
+	{nil, nil, true},
+	{[]byte("secret"), []byte("secret"), true},
+	{[]byte("secret"), []byte("other"), false},
+	{nil, []byte("secret"), false},
+}
+
+func handshake(clientPSK, serverPSK []byte) (*Session, *Session, error) {
+	ck, err := GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	sk, err := GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := NewSession(sk, ck.PublicKey(), serverPSK, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := DecodeHandshakeReply(ck, EncodeHandshakeReply(sk, server), clientPSK)
+	return client, server, err
+}
+
+func TestHandshake(t *testing.T) {
+	for _, tt := range handshakeTests {
+		_, _, err := handshake(tt.clientPSK, tt.serverPSK)
+		if tt.ok && err != nil {
+			t.Errorf("client psk %q, server psk %q: got %v, want no error", tt.clientPSK, tt.serverPSK, err)
+		}
+		if !tt.ok && err != HandshakeError {
+			t.Errorf("client psk %q, server psk %q: got %v, want %v", tt.clientPSK, tt.serverPSK, err, HandshakeError)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	client, server, err := handshake(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := gatt.UUID16(HTTPURIID)
+	want := []byte("localhost:8100/hello.txt")
+
+	sealed := client.Seal(uri, want)
+	if len(sealed) != len(want)+SealOverhead {
+		t.Errorf("got %d octets, want %d", len(sealed), len(want)+SealOverhead)
+	}
+	got, err := server.Open(uri, sealed)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("got %q, %v, want %q", got, err, want)
+	}
+
+	// Values are bound to their direction and characteristic
+	if _, err := client.Open(uri, sealed); err != DecryptError {
+		t.Errorf("open own value: got %v, want %v", err, DecryptError)
+	}
+	if _, err := server.Open(gatt.UUID16(HTTPEntityBodyID), sealed); err != DecryptError {
+		t.Errorf("open other characteristic: got %v, want %v", err, DecryptError)
+	}
+}
+
+func TestOpenRejectsReplay(t *testing.T) {
+	client, server, err := handshake(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := gatt.UUID16(HTTPURIID)
+	body := gatt.UUID16(HTTPEntityBodyID)
+
+	first := client.Seal(uri, []byte("localhost:8100/hello.txt"))
+	second := client.Seal(body, []byte("hello"))
+	third := client.Seal(uri, []byte("localhost:8100/bye.txt"))
+
+	// Counters only have to increase per characteristic, values for
+	// different characteristics may arrive out of order
+	for _, v := range []struct {
+		u gatt.UUID
+		b []byte
+	}{{uri, first}, {uri, third}, {body, second}} {
+		if _, err := server.Open(v.u, v.b); err != nil {
+			t.Fatalf("open %s: got %v, want no error", v.u, err)
+		}
+	}
+
+	// Replayed, or older than the last value opened
+	if _, err := server.Open(uri, third); err != ReplayError {
+		t.Errorf("open replayed value: got %v, want %v", err, ReplayError)
+	}
+	if _, err := server.Open(uri, first); err != ReplayError {
+		t.Errorf("open older value: got %v, want %v", err, ReplayError)
+	}
+	if _, err := server.Open(body, second); err != ReplayError {
+		t.Errorf("open replayed body: got %v, want %v", err, ReplayError)
+	}
+}
@@ -0,0 +1,168 @@
+package hps
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+// BodyClosedError is returned when reading a streamed body after Close
+var BodyClosedError = errors.New("Read on closed response body")
+
+// bodyStream reads the rest of a response body from the body segment
+// characteristic, as the caller reads it. It keeps the connection & the
+// adapter until closed, or the end of the body is read.
+type bodyStream struct {
+	tx *transaction
+	p  gatt.Peripheral
+
+	// release ends the request's turn on the adapter, see Client.do
+	release func()
+
+	mu     sync.Mutex
+	buf    []byte
+	err    error
+	closed bool
+}
+
+// moreBody reports whether the peripheral has more of the body than was
+// read, either because it was truncated, or it is shorter than its
+// Content-Length
+func moreBody(ns NotifyStatus, headers []byte, n int) bool {
+	if ns.BodyTruncated {
+		return true
+	}
+	l, err := strconv.Atoi(DecodeHeaders(headers).Get("Content-Length"))
+	return err == nil && l > n
+}
+
+// startStream streams the body from offset, the octets read already
+func (tx *transaction) startStream(p gatt.Peripheral, offset int) error {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(offset))
+	if err := tx.writeCharacteristic(p, tx.segmentChr, b, false); err != nil {
+		return err
+	}
+	log.Printf("streaming body from offset %d", offset)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.stream = &bodyStream{tx: tx, p: p}
+	return nil
+}
+
+func (s *bodyStream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) == 0 {
+		if s.closed {
+			return 0, BodyClosedError
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		seg, err := s.tx.readSegment(s.p)
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+		if len(seg) == 0 {
+			// Let the next request have the adapter, without waiting for
+			// the caller to close the body
+			s.err = io.EOF
+			s.stop()
+			return 0, io.EOF
+		}
+		s.buf = seg
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Close disconnects from the peripheral, and releases the adapter
+func (s *bodyStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.stop()
+		s.closed = true
+	}
+	return nil
+}
+
+// stop disconnects, once
+func (s *bodyStream) stop() {
+	if s.p == nil {
+		return
+	}
+	s.p.Device().CancelConnection(s.p)
+	stopDevice(s.p.Device())
+	s.p = nil
+	if s.release != nil {
+		s.release()
+		s.release = nil
+	}
+}
+
+// readSegment reads the next segment of the body, which is empty at the
+// end. gatt doesn't time reads out, so give up after ResponseTimeout.
+func (tx *transaction) readSegment(p gatt.Peripheral) ([]byte, error) {
+	type result struct {
+		b   []byte
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		b, err := tx.readCharacteristic(p, tx.segmentChr)
+		c <- result{b, err}
+	}()
+	t := time.NewTimer(tx.client.ResponseTimeout)
+	defer t.Stop()
+	select {
+	case r := <-c:
+		return r.b, r.err
+	case <-tx.disconnected:
+		return nil, &ConnectError{PeripheralID: p.ID(), Err: DisconnectedError}
+	case <-t.C:
+		return nil, &UpstreamError{Err: ResponseTimeoutError}
+	case <-tx.req.ctx.Done():
+		return nil, tx.req.ctx.Err()
+	}
+}
+
+// stopDevice releases the adapter
+func stopDevice(d gatt.Device) {
+	if s, ok := d.(interface{ Stop() error }); ok {
+		s.Stop()
+	}
+}
+
+// streamedBody is the body of an HTTPResponse, the octets read already
+// followed by the stream
+type streamedBody struct {
+	io.Reader
+	stream *bodyStream
+}
+
+func (b streamedBody) Close() error {
+	return b.stream.Close()
+}
+
+// contentLength is the body's length, -1 if a streamed body has no
+// Content-Length
+func contentLength(r Response, h http.Header) int64 {
+	if r.stream == nil {
+		return int64(len(r.Body))
+	}
+	if l, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		return l
+	}
+	return -1
+}
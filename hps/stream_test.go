@@ -0,0 +1,61 @@
+package hps
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+var moreBodyTests = []struct {
+	ns      NotifyStatus
+	headers string
+	n       int
+	want    bool
+}{
+	{NotifyStatus{BodyTruncated: true}, "", 5, true},
+	{NotifyStatus{}, "Content-Length=12", 5, true},
+	{NotifyStatus{}, "Content-Length=5", 5, false},
+	{NotifyStatus{}, "Content-Type=text/plain", 5, false},
+}
+
+func TestMoreBody(t *testing.T) {
+	for _, tt := range moreBodyTests {
+		if got := moreBody(tt.ns, []byte(tt.headers), tt.n); got != tt.want {
+			t.Errorf("moreBody(%+v, %q, %d): got %v, want %v", tt.ns, tt.headers, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestStreamedBody(t *testing.T) {
+	// A stream that has already reached the end of the body
+	s := &bodyStream{buf: []byte(" world"), err: io.EOF}
+	r := Response{
+		NotifyStatus: NotifyStatus{StatusCode: http.StatusOK, BodyTruncated: true},
+		Headers:      []byte("Content-Length=11"),
+		Body:         []byte("hello"),
+		stream:       s,
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8100/hello.txt", nil)
+	resp := newHTTPResponse(req, r)
+	if resp.BodyTruncated || resp.ContentLength != 11 {
+		t.Errorf("got truncated: %v, length: %d", resp.BodyTruncated, resp.ContentLength)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(b) != "hello world" {
+		t.Errorf("body: got %q, err: %v", b, err)
+	}
+	resp.Body.Close()
+	if _, err := s.Read(make([]byte, 1)); err != BodyClosedError {
+		t.Errorf("read after close: got %v", err)
+	}
+
+	r.Headers = nil
+	if l := contentLength(r, r.DecodedHeaders()); l != -1 {
+		t.Errorf("unknown length: got %d", l)
+	}
+	r.stream = nil
+	if l := contentLength(r, r.DecodedHeaders()); l != 5 {
+		t.Errorf("not streamed: got %d", l)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessEntry describes one HPS transaction
+type accessEntry struct {
+	Time             time.Time `json:"time"`
+	CentralID        string    `json:"central_id"`
+	Method           string    `json:"method"`
+	URL              string    `json:"url"`
+	Status           int       `json:"status"`
+	BytesIn          int       `json:"bytes_in"`
+	BytesOut         int       `json:"bytes_out"`
+	HeadersTruncated bool      `json:"headers_truncated"`
+	BodyTruncated    bool      `json:"body_truncated"`
+	UpstreamMillis   int64     `json:"upstream_ms"`
+	BLEMillis        int64     `json:"ble_ms"`
+}
+
+func newAccessEntry(t *transaction, now time.Time) accessEntry {
+	e := accessEntry{
+		Time:             now,
+		CentralID:        t.Request.CentralID,
+		Method:           t.Request.Method,
+		URL:              t.Request.URL(),
+		Status:           t.NotifyStatus.StatusCode,
+		BytesIn:          len(t.Request.Body),
+		BytesOut:         int(atomic.LoadInt64(&t.sent)),
+		HeadersTruncated: t.NotifyStatus.HeadersTruncated,
+		BodyTruncated:    t.NotifyStatus.BodyTruncated,
+		UpstreamMillis:   t.Upstream.Milliseconds(),
+	}
+	if !t.Request.Started.IsZero() {
+		e.BLEMillis = now.Sub(t.Request.Started).Milliseconds()
+	}
+	return e
+}
+
+// sentBody counts body octets read by the central, over one read or many
+// segments. Compressed bodies are counted as sent.
+func (t *transaction) sentBody(n int) {
+	atomic.AddInt64(&t.sent, int64(n))
+}
+
+// finish logs a notified transaction, once the central is done reading it:
+// when the next request arrives, the central disconnects, or on shutdown
+func (t *transaction) finish(now time.Time) {
+	if t == nil || !t.notified() {
+		return
+	}
+	t.logOnce.Do(func() { accessLog.record(t, now) })
+}
+
+// clf formats the entry in Common Log Format, with the HPS specific fields
+// appended as key=value pairs
+func (e accessEntry) clf() string {
+	return fmt.Sprintf("%s - - [%s] \"%s %s HPS\" %d %d in=%d headers_truncated=%t body_truncated=%t upstream_ms=%d ble_ms=%d\n",
+		e.CentralID, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.URL, e.Status, e.BytesOut,
+		e.BytesIn, e.HeadersTruncated, e.BodyTruncated, e.UpstreamMillis, e.BLEMillis)
+}
+
+type accessLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+// newAccessLogger writes to path, or stdout if path is empty. The file is
+// rotated when it reaches maxSize megabytes.
+func newAccessLogger(path, format string, maxSize, backups int) (*accessLogger, error) {
+	l := &accessLogger{w: os.Stdout}
+	switch format {
+	case "clf":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("Unsupported access log format '%s', valid values are clf and json", format)
+	}
+	if path != "" {
+		f, err := openRotatingFile(path, int64(maxSize)*1024*1024, backups)
+		if err != nil {
+			return nil, err
+		}
+		l.w = f
+	}
+	return l, nil
+}
+
+func (l *accessLogger) record(t *transaction, now time.Time) {
+	e := newAccessEntry(t, now)
+	var b []byte
+	if l.json {
+		b, _ = json.Marshal(e)
+		b = append(b, '\n')
+	} else {
+		b = []byte(e.clf())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(b); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: write access log %v\n", err)
+	}
+}
+
+// rotatingFile is an append only file, that is renamed to path.1 once it
+// reaches maxSize. Older files are shifted up to path.{backups}.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+	size    int64
+	f       *os.File
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	for i := r.backups; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i-1), fmt.Sprintf("%s.%d", r.path, i))
+	}
+	if r.backups > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
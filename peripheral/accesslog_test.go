@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+func testTransaction() *transaction {
+	t := &transaction{
+		Response: &hps.Response{
+			NotifyStatus: hps.NotifyStatus{StatusCode: 200, BodyTruncated: true},
+			Body:         []byte(strings.Repeat("a", 600)),
+		},
+		Request: savedRequest{
+			URI:       "localhost:8100/hello.txt",
+			Scheme:    "http",
+			Method:    "POST",
+			Body:      []byte("hello"),
+			CentralID: "central-1",
+			Started:   time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		},
+		Upstream: 20 * time.Millisecond,
+	}
+	t.Notified = true
+	return t
+}
+
+func TestAccessEntryFormats(t *testing.T) {
+	tx := testTransaction()
+	tx.sentBody(255)
+	tx.sentBody(100)
+	e := newAccessEntry(tx, tx.Request.Started.Add(1500*time.Millisecond))
+
+	want := `central-1 - - [04/Mar/2021:05:06:08 +0000] "POST http://localhost:8100/hello.txt HPS" 200 355 in=5 headers_truncated=false body_truncated=true upstream_ms=20 ble_ms=1500` + "\n"
+	if got := e.clf(); got != want {
+		t.Errorf("clf: got %q, want %q", got, want)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(b, &m)
+	if m["central_id"] != "central-1" || m["bytes_out"] != 355.0 || m["bytes_in"] != 5.0 || m["body_truncated"] != true || m["ble_ms"] != 1500.0 {
+		t.Errorf("json: got %s", b)
+	}
+}
+
+func TestFinishLogsOnce(t *testing.T) {
+	defer func(l *accessLogger) { accessLog = l }(accessLog)
+	var buf bytes.Buffer
+	accessLog = &accessLogger{w: &buf}
+
+	tx := testTransaction()
+	tx.Notified = false
+	tx.finish(time.Now())
+	if buf.Len() != 0 {
+		t.Errorf("not notified: got %q", buf.String())
+	}
+	tx.Notified = true
+	tx.finish(time.Now())
+	tx.finish(time.Now())
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("got %d lines, want 1", n)
+	}
+	var none *transaction
+	none.finish(time.Now())
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for p, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if b, err := ioutil.ReadFile(p); err != nil || string(b) != want {
+			t.Errorf("%s: got %q, err: %v", filepath.Base(p), b, err)
+		}
+	}
+	if _, err := ioutil.ReadFile(path + ".3"); err == nil {
+		t.Errorf("got a third backup, want 2")
+	}
+
+	// Reopening appends, counting the existing size
+	r.f.Close()
+	r, err = openRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("fifth\n"))
+	if b, _ := ioutil.ReadFile(path); string(b) != "fifth\n" {
+		t.Errorf("no backups: got %q", b)
+	}
+	r.f.Close()
+}
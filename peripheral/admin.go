@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+// recentTransactions is the number of transactions kept for the admin API
+const recentTransactions = 50
+
+type connectedCentral struct {
+	central   gatt.Central
+	Connected time.Time `json:"connected"`
+}
+
+type inflightRequest struct {
+	CentralID string    `json:"central_id"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Started   time.Time `json:"started"`
+}
+
+// gatewayState is what the admin API reports on, and controls
+type gatewayState struct {
+	mu                sync.Mutex
+	adapter           gatt.State
+	adapterChanged    time.Time
+	name              string
+	advertising       bool
+	advertisingPaused bool
+	centrals          map[string]*connectedCentral
+	inflight          map[int]inflightRequest
+	nextID            int
+	recent            []accessEntry
+}
+
+func newGatewayState() *gatewayState {
+	return &gatewayState{
+		centrals: map[string]*connectedCentral{},
+		inflight: map[int]inflightRequest{},
+	}
+}
+
+func (g *gatewayState) setAdapter(s gatt.State) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if s != g.adapter {
+		g.adapterChanged = time.Now()
+	}
+	g.adapter = s
+}
+
+// adapterState is the adapter's state, and when it changed to it
+func (g *gatewayState) adapterState() (gatt.State, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.adapter, g.adapterChanged
+}
+
+func (g *gatewayState) setAdvertising(name string, advertising bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.name = name
+	g.advertising = advertising
+}
+
+func (g *gatewayState) pauseAdvertising(paused bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.advertisingPaused = paused
+}
+
+func (g *gatewayState) isAdvertisingPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.advertisingPaused
+}
+
+func (g *gatewayState) connect(c gatt.Central) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.centrals[c.ID()] = &connectedCentral{central: c, Connected: time.Now()}
+}
+
+func (g *gatewayState) disconnect(c gatt.Central) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.centrals, c.ID())
+}
+
+func (g *gatewayState) central(id string) gatt.Central {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.centrals[id]; ok {
+		return c.central
+	}
+	return nil
+}
+
+func (g *gatewayState) connectedCentrals() []gatt.Central {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cs := []gatt.Central{}
+	for _, c := range g.centrals {
+		cs = append(cs, c.central)
+	}
+	return cs
+}
+
+// begin records an upstream call, call the returned function once it completes
+func (g *gatewayState) begin(r savedRequest) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id := g.nextID
+	g.nextID++
+	g.inflight[id] = inflightRequest{CentralID: r.CentralID, Method: r.Method, URL: r.URL(), Started: time.Now()}
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.inflight, id)
+	}
+}
+
+func (g *gatewayState) record(t *transaction, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.recent = append(g.recent, newAccessEntry(t, now))
+	if len(g.recent) > recentTransactions {
+		g.recent = g.recent[len(g.recent)-recentTransactions:]
+	}
+}
+
+type gatewayStatus struct {
+	Adapter           string            `json:"adapter"`
+	Name              string            `json:"name"`
+	Advertising       bool              `json:"advertising"`
+	AdvertisingPaused bool              `json:"advertising_paused"`
+	Centrals          []centralStatus   `json:"centrals"`
+	Inflight          []inflightRequest `json:"inflight"`
+	Recent            []accessEntry     `json:"recent"`
+}
+
+type centralStatus struct {
+	ID        string    `json:"id"`
+	Connected time.Time `json:"connected"`
+}
+
+func (g *gatewayState) status() gatewayStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := gatewayStatus{
+		Adapter:           g.adapter.String(),
+		Name:              g.name,
+		Advertising:       g.advertising,
+		AdvertisingPaused: g.advertisingPaused,
+		Centrals:          []centralStatus{},
+		Inflight:          []inflightRequest{},
+		Recent:            append([]accessEntry{}, g.recent...),
+	}
+	for id, c := range g.centrals {
+		s.Centrals = append(s.Centrals, centralStatus{ID: id, Connected: c.Connected})
+	}
+	sort.Slice(s.Centrals, func(i, j int) bool { return s.Centrals[i].Connected.Before(s.Centrals[j].Connected) })
+	for _, r := range g.inflight {
+		s.Inflight = append(s.Inflight, r)
+	}
+	sort.Slice(s.Inflight, func(i, j int) bool { return s.Inflight[i].Started.Before(s.Inflight[j].Started) })
+	return s
+}
+
+// adminHandler serves the admin API:
+//
+//	GET  /status                     adapter, advertising, centrals, in-flight & recent requests
+//	POST /centrals/{id}/disconnect   disconnect a central
+//	POST /advertising/pause          stop advertising
+//	POST /advertising/resume         restart advertising
+//	POST /cache/flush                empty the response cache
+func adminHandler(g *gatewayState) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(g.status())
+	})
+	mux.HandleFunc("/centrals/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/centrals/"), "/")
+		if len(parts) != 2 || parts[1] != "disconnect" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c := g.central(parts[0])
+		if c == nil {
+			http.Error(w, "central not connected", http.StatusNotFound)
+			return
+		}
+		log.Printf("admin: disconnecting central_id: %s", c.ID())
+		if err := c.Close(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	pause := func(paused bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			log.Printf("admin: advertising paused: %t", paused)
+			g.pauseAdvertising(paused)
+			adv.refresh()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	mux.HandleFunc("/advertising/pause", pause(true))
+	mux.HandleFunc("/advertising/resume", pause(false))
+	mux.HandleFunc("/cache/flush", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flushCache()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// listenAdmin listens on a TCP address, or a Unix socket given as unix:{path}
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		// Remove a socket left behind by a previous run
+		os.Remove(path)
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// The socket is created with the umask, only the owner may use the API
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("Admin API must listen on localhost or a unix socket, not '%s'", addr)
+	}
+	return net.Listen("tcp", addr)
+}
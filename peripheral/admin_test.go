@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// closingCentral records being closed, closeErr is returned by Close
+type closingCentral struct {
+	testCentral
+	closed   bool
+	closeErr error
+}
+
+func (c *closingCentral) Close() error {
+	c.closed = true
+	return c.closeErr
+}
+
+func TestAdminStatus(t *testing.T) {
+	g := newGatewayState()
+	g.setAdvertising("gateway", true)
+	g.connect(testCentral{id: "central-1"})
+	done := g.begin(savedRequest{CentralID: "central-1", Method: "GET"})
+	defer done()
+
+	srv := httptest.NewServer(adminHandler(g))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	var s gatewayStatus
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "gateway" || !s.Advertising || s.AdvertisingPaused {
+		t.Errorf("got advertising %+v", s)
+	}
+	if len(s.Centrals) != 1 || s.Centrals[0].ID != "central-1" {
+		t.Errorf("got centrals %+v", s.Centrals)
+	}
+	if len(s.Inflight) != 1 || s.Inflight[0].Method != "GET" {
+		t.Errorf("got inflight %+v", s.Inflight)
+	}
+
+	resp, err = http.Post(srv.URL+"/status", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status: got status %d", resp.StatusCode)
+	}
+}
+
+func TestAdminDisconnect(t *testing.T) {
+	g := newGatewayState()
+	c := &closingCentral{testCentral: testCentral{id: "central-1"}}
+	g.connect(c)
+	failing := &closingCentral{testCentral: testCentral{id: "central-2"}, closeErr: errors.New("closed")}
+	g.connect(failing)
+
+	srv := httptest.NewServer(adminHandler(g))
+	defer srv.Close()
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{"POST", "/centrals/central-1/disconnect", http.StatusNoContent},
+		{"POST", "/centrals/central-2/disconnect", http.StatusInternalServerError},
+		{"POST", "/centrals/unknown/disconnect", http.StatusNotFound},
+		{"POST", "/centrals/central-1", http.StatusNotFound},
+		{"GET", "/centrals/central-1/disconnect", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+	if !c.closed || !failing.closed {
+		t.Errorf("centrals not closed")
+	}
+}
+
+func TestAdminPause(t *testing.T) {
+	g := newGatewayState()
+	srv := httptest.NewServer(adminHandler(g))
+	defer srv.Close()
+
+	post := func(path string) int {
+		resp, err := http.Post(srv.URL+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := post("/advertising/pause"); got != http.StatusNoContent {
+		t.Errorf("pause: got status %d", got)
+	}
+	if !g.isAdvertisingPaused() {
+		t.Errorf("advertising not paused")
+	}
+	if got := post("/advertising/resume"); got != http.StatusNoContent {
+		t.Errorf("resume: got status %d", got)
+	}
+	if g.isAdvertisingPaused() {
+		t.Errorf("advertising still paused")
+	}
+
+	resp, err := http.Get(srv.URL + "/advertising/pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET pause: got status %d", resp.StatusCode)
+	}
+}
+
+func TestListenAdminSocketMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := listenAdmin("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("got mode %o, want 600", mode)
+	}
+}
+
+func TestListenAdminLocalOnly(t *testing.T) {
+	if _, err := listenAdmin("0.0.0.0:0"); err == nil {
+		t.Errorf("listening on all interfaces")
+	}
+	l, err := listenAdmin("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
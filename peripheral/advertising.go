@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidoram/bluetooth/hps"
+	"github.com/paypal/gatt"
+)
+
+const (
+	maxAdvertisingOctets = 31
+
+	advFlags            = 0x01
+	advTxPower          = 0x0A
+	advServiceData      = 0x16
+	advManufacturerData = 0xFF
+
+	// advGeneralDiscoverable | advLEOnly
+	advDiscoverableLEOnly = 0x06
+
+	// noTxPower leaves the TX power level out of the advertisement, it is
+	// the HCI value for 'not available'
+	noTxPower = 127
+
+	minAdvertisingInterval = time.Millisecond * 20
+	maxAdvertisingInterval = time.Millisecond * 10240
+)
+
+// serviceData is advertised in the scan response, for a 16 bit service UUID
+type serviceData struct {
+	uuid uint16
+	data []byte
+}
+
+// parseServiceData parses values of the form '{16 bit uuid}={hex}', eg:
+// '180A=0102'
+func parseServiceData(values hps.ArrayStr) ([]serviceData, error) {
+	var sd []serviceData
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid service data '%s', expected uuid=hex", v)
+		}
+		u, err := strconv.ParseUint(kv[0], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid service data '%s', expected a 16 bit uuid", v)
+		}
+		b, err := hex.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid service data '%s', err: %v", v, err)
+		}
+		sd = append(sd, serviceData{uuid: uint16(u), data: b})
+	}
+	return sd, nil
+}
+
+// gatewayID derives a stable gateway ID from the serial number
+func gatewayID(serial string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(serial))
+	return h.Sum32()
+}
+
+// advertisingConfig is the content of the advertisements
+type advertisingConfig struct {
+	Name        string
+	CompanyID   uint16
+	GatewayID   uint32
+	TxPower     int
+	ServiceData []serviceData
+
+	// Interval between advertisements, zero for the adapter's default
+	Interval time.Duration
+}
+
+// packets builds the advertisement, holding the services & gateway info, and
+// the scan response holding the name, TX power & service data. Fields that
+// don't fit are left out.
+func (c advertisingConfig) packets(services []gatt.UUID, load uint8) (adv, scan *gatt.AdvPacket, dropped []string) {
+	adv = &gatt.AdvPacket{}
+	adv.AppendField(advFlags, []byte{advDiscoverableLEOnly})
+	adv.AppendUUIDFit(services)
+	fit := func(p *gatt.AdvPacket, name string, n int) bool {
+		if p.Len()+2+n > maxAdvertisingOctets {
+			dropped = append(dropped, name)
+			return false
+		}
+		return true
+	}
+	info := hps.GatewayInfo{ID: c.GatewayID, Load: load}.Encode(c.CompanyID)
+	if fit(adv, "manufacturer data", len(info)) {
+		adv.AppendField(advManufacturerData, info)
+	}
+
+	scan = &gatt.AdvPacket{}
+	if c.TxPower != noTxPower && fit(scan, "tx power", 1) {
+		scan.AppendField(advTxPower, []byte{byte(int8(c.TxPower))})
+	}
+	for _, sd := range c.ServiceData {
+		if fit(scan, fmt.Sprintf("service data %04X", sd.uuid), 2+len(sd.data)) {
+			scan.AppendField(advServiceData, append([]byte{byte(sd.uuid), byte(sd.uuid >> 8)}, sd.data...))
+		}
+	}
+	// The name goes last, AppendName shortens it to fit
+	if scan.Len()+3 <= maxAdvertisingOctets {
+		scan.AppendName(c.Name)
+	} else {
+		dropped = append(dropped, "name")
+	}
+	return adv, scan, dropped
+}
+
+// advertiser keeps the advertisement up to date. The HCI layer re-enables
+// advertising after each connection, so the advertisement only needs
+// updating when the adapter is powered on, advertising is paused or resumed,
+// or the gateway's load changes. When advertising is paused or stopped it has
+// to be stopped again after each connection, see reassert.
+type advertiser struct {
+	cfg advertisingConfig
+
+	mu          sync.Mutex
+	d           gatt.Device
+	services    []gatt.UUID
+	enabled     bool
+	advertising bool
+	last        []byte
+	err         error
+}
+
+// adv is the advertiser, set once the device is created
+var adv *advertiser
+
+func newAdvertiser(cfg advertisingConfig) *advertiser {
+	return &advertiser{cfg: cfg}
+}
+
+// start advertises the services, once the adapter is powered on
+func (a *advertiser) start(d gatt.Device, services []gatt.UUID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.d = d
+	a.services = services
+	a.enabled = true
+	a.advertising = false
+	// The parameters are only sent with the next advertisement, and are lost
+	// when the adapter is reset, so set them each time it is powered on
+	if a.cfg.Interval > 0 {
+		if err := d.Option(advertisingOptions(a.cfg.Interval)...); err != nil {
+			log.Printf("Error: advertising parameters %v", err)
+		}
+	}
+	if _, _, dropped := a.cfg.packets(services, 0); len(dropped) > 0 {
+		log.Printf("Warn: advertisement too long, leaving out %s", strings.Join(dropped, ", "))
+	}
+	a.update()
+}
+
+// stop stops advertising, until start is called again
+func (a *advertiser) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.enabled = false
+	a.update()
+}
+
+// refresh updates the advertisement, if its content has changed
+func (a *advertiser) refresh() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.update()
+}
+
+// reassert stops advertising again if it is paused or stopped, as the HCI
+// layer re-enables it whenever a central connects or disconnects
+func (a *advertiser) reassert() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.d == nil || (a.enabled && !gateway.isAdvertisingPaused()) {
+		return
+	}
+	if a.err = a.d.StopAdvertising(); a.err != nil {
+		log.Printf("Error: stop advertising %v", a.err)
+	}
+}
+
+// lastError is the error from the last advertising HCI command
+func (a *advertiser) lastError() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+func (a *advertiser) update() {
+	if a.d == nil {
+		return
+	}
+	if !a.enabled || gateway.isAdvertisingPaused() {
+		if a.advertising {
+			log.Printf("stop advertising")
+			a.err = a.d.StopAdvertising()
+			a.advertising = false
+			a.last = nil
+			stats.setAdvertising(false)
+			gateway.setAdvertising(a.cfg.Name, false)
+		}
+		return
+	}
+
+	p, scan, _ := a.cfg.packets(a.services, limits.load())
+	b := append(packetBytes(p), packetBytes(scan)...)
+	if a.advertising && bytes.Equal(b, a.last) {
+		return
+	}
+	if a.err = advertise(a.d, p, scan); a.err != nil {
+		log.Printf("Error: advertise %v", a.err)
+		return
+	}
+	a.last = b
+	if !a.advertising {
+		log.Printf("start advertising")
+		a.advertising = true
+		stats.setAdvertising(true)
+		gateway.setAdvertising(a.cfg.Name, true)
+	}
+}
+
+func packetBytes(p *gatt.AdvPacket) []byte {
+	b := p.Bytes()
+	return b[:p.Len()]
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+
+	"github.com/paypal/gatt"
+	"github.com/paypal/gatt/linux/cmd"
+)
+
+// advertisingOptions sets the advertising interval, in units of 0.625ms
+func advertisingOptions(interval time.Duration) []gatt.Option {
+	units := uint16(interval / (time.Microsecond * 625))
+	return []gatt.Option{
+		gatt.LnxSetAdvertisingParameters(&cmd.LESetAdvertisingParameters{
+			AdvertisingIntervalMin: units,
+			AdvertisingIntervalMax: units,
+			AdvertisingType:        0x00, // ADV_IND, connectable
+			AdvertisingChannelMap:  0x7,  // All three channels
+		}),
+	}
+}
+
+func advertise(d gatt.Device, adv, scan *gatt.AdvPacket) error {
+	if err := d.Option(gatt.LnxSetScanResponseData(&cmd.LESetScanResponseData{
+		ScanResponseDataLength: uint8(scan.Len()),
+		ScanResponseData:       scan.Bytes(),
+	})); err != nil {
+		return err
+	}
+	return d.Advertise(adv)
+}
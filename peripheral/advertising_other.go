@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+// advertisingOptions does nothing, the OS picks the advertising interval
+func advertisingOptions(interval time.Duration) []gatt.Option {
+	return nil
+}
+
+// advertise sends the advertisement only, scan responses are Linux only
+func advertise(d gatt.Device, adv, scan *gatt.AdvPacket) error {
+	return d.Advertise(adv)
+}
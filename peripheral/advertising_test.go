@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/davidoram/bluetooth/hps"
+	"github.com/paypal/gatt"
+)
+
+func TestAdvertisingPackets(t *testing.T) {
+	services := []gatt.UUID{gatt.MustParseUUID(hps.HpsServiceID)}
+	sd, err := parseServiceData(hps.ArrayStr{"180A=0102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := advertisingConfig{Name: hps.DeviceName, CompanyID: hps.CompanyID, GatewayID: 42, TxPower: -4, ServiceData: sd}
+	adv, scan, dropped := c.packets(services, 25)
+	if len(dropped) > 0 {
+		t.Errorf("dropped %v", dropped)
+	}
+	b := packetBytes(adv)
+	if len(b) != 31 {
+		t.Errorf("advertisement: got %d octets, want 31", len(b))
+	}
+	// The manufacturer data is the last field
+	info, err := hps.DecodeGatewayInfo(b[len(b)-8:], hps.CompanyID)
+	if err != nil || info.ID != 42 || info.Load != 25 {
+		t.Errorf("gateway info: got %+v %v", info, err)
+	}
+	want := []byte{0x02, advTxPower, 0xfc, 0x05, advServiceData, 0x0a, 0x18, 0x01, 0x02}
+	if s := packetBytes(scan); !bytes.HasPrefix(s, want) || !bytes.HasSuffix(s, []byte(hps.DeviceName)) {
+		t.Errorf("scan response: got %x", s)
+	}
+
+	// The name is shortened, service data that doesn't fit is left out
+	c.Name = "a very long gateway name for the scan response"
+	c.ServiceData = append(c.ServiceData, serviceData{uuid: 0x180F, data: make([]byte, 20)})
+	_, scan, dropped = c.packets(services, 0)
+	if len(dropped) != 1 || scan.Len() != 31 {
+		t.Errorf("got dropped %v, scan response %d octets", dropped, scan.Len())
+	}
+}
+
+func TestParseServiceData(t *testing.T) {
+	for _, v := range []string{"180A", "xyz=01", "180A=0g", "12345=01"} {
+		if _, err := parseServiceData(hps.ArrayStr{v}); err == nil {
+			t.Errorf("parseServiceData(%q): expected an error", v)
+		}
+	}
+}
+
+func TestAdvertiserParameters(t *testing.T) {
+	defer func(g *gatewayState) { gateway = g }(gateway)
+	gateway = newGatewayState()
+	services := []gatt.UUID{gatt.MustParseUUID(hps.HpsServiceID)}
+
+	// The options set without an interval, eg: the scan response
+	d := &testDevice{}
+	newAdvertiser(advertisingConfig{Name: "gateway"}).start(d, services)
+	base := d.options
+
+	a := newAdvertiser(advertisingConfig{Name: "gateway", Interval: time.Millisecond * 500})
+	d = &testDevice{}
+	a.start(d, services)
+	if d.options != base+1 {
+		t.Errorf("got %d options, want %d", d.options, base+1)
+	}
+
+	// The adapter is reset, and powered on again
+	a.stop()
+	d.options = 0
+	a.start(d, services)
+	if d.options != base+1 || !d.advertising {
+		t.Errorf("after reset: got %d options, want %d", d.options, base+1)
+	}
+}
+
+// connectedDevice re-enables advertising whenever a central connects or
+// disconnects, as the HCI layer does
+type connectedDevice struct {
+	*testDevice
+}
+
+func (d connectedDevice) connect(c gatt.Central) {
+	d.advertising = true
+	centralConnected(c)
+}
+
+func (d connectedDevice) disconnect(c gatt.Central) {
+	d.advertising = true
+	centralDisconnected(c)
+}
+
+func TestPauseSurvivesConnections(t *testing.T) {
+	defer func(g *gatewayState, a *advertiser, l *secureLinks) {
+		gateway, adv, links = g, a, l
+	}(gateway, adv, links)
+	gateway = newGatewayState()
+	links = newSecureLinks(nil, false)
+	adv = newAdvertiser(advertisingConfig{Name: "gateway"})
+	d := connectedDevice{&testDevice{}}
+	adv.start(d, []gatt.UUID{gatt.MustParseUUID(hps.HpsServiceID)})
+
+	gateway.pauseAdvertising(true)
+	adv.refresh()
+	c := testCentral{id: "central"}
+	d.connect(c)
+	if d.advertising || gateway.status().Advertising {
+		t.Errorf("paused, after connect: got advertising %t, status %t, want false", d.advertising, gateway.status().Advertising)
+	}
+	d.disconnect(c)
+	if d.advertising || gateway.status().Advertising {
+		t.Errorf("paused, after disconnect: got advertising %t, status %t, want false", d.advertising, gateway.status().Advertising)
+	}
+
+	// Resumed, connections leave advertising on
+	gateway.pauseAdvertising(false)
+	adv.refresh()
+	d.connect(c)
+	if !d.advertising || !gateway.status().Advertising {
+		t.Errorf("resumed, after connect: got advertising %t, status %t, want true", d.advertising, gateway.status().Advertising)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+// responseCache holds upstream GET responses, nil if caching is disabled
+var responseCache *hps.MemoryCache
+
+// fetch makes the upstream call, serving from the response cache where the
+// HTTP caching headers allow
+func fetch(client *http.Client, req *http.Request) (*http.Response, error) {
+	if responseCache == nil || req.Method != http.MethodGet {
+		return client.Do(req)
+	}
+
+	key := hps.CacheKey(req.Method, req.URL.String())
+	cached, ok := responseCache.Get(key)
+	if ok && !cached.Matches(req.Header) {
+		ok = false
+	}
+	// Conditional requests from the central are passed through, the
+	// central is revalidating its own copy
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		ok = false
+	}
+	if ok && cached.Fresh(req.Header, time.Now(), true) {
+		log.Printf("cache hit %s", key)
+		return cachedResponse(cached, req), nil
+	}
+	if ok {
+		cached.Revalidate(req.Header)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		if ok && cached.StaleIfError(req.Header, time.Now(), true) {
+			log.Printf("cache serving stale %s, upstream failed", key)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return cachedResponse(cached, req), nil
+		}
+		return resp, err
+	}
+	if ok && resp.StatusCode == http.StatusNotModified {
+		log.Printf("cache revalidated %s", key)
+		resp.Body.Close()
+		refreshed := cached.Refresh(resp.Header, time.Now())
+		responseCache.Set(key, refreshed)
+		return cachedResponse(refreshed, req), nil
+	}
+	if !hps.Cacheable(req.Method, req.Header, resp.StatusCode, resp.Header, true) {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	responseCache.Set(key, hps.NewCachedResponse(req.Header, resp.StatusCode, resp.Header, body, time.Now()))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// cachedResponse builds an upstream response from the cache
+func cachedResponse(c *hps.CachedResponse, req *http.Request) *http.Response {
+	h := c.Header.Clone()
+	h.Set("Age", strconv.Itoa(int(c.Age(time.Now()).Seconds())))
+	return &http.Response{
+		Status:        strconv.Itoa(c.StatusCode) + " " + http.StatusText(c.StatusCode),
+		StatusCode:    c.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+}
+
+// flushCache empties the response cache
+func flushCache() {
+	if responseCache != nil {
+		log.Printf("flushing %d cached responses", responseCache.Len())
+		responseCache.Flush()
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+
+	"github.com/davidoram/bluetooth/hps"
+	"github.com/paypal/gatt"
+)
+
+// capabilities lists the extensions to the HPS spec we support. Compressed
+// request bodies & headers are always decoded, but only offered with
+// --compress.
+func capabilities() hps.Capabilities {
+	f := hps.FeatureEncryption | hps.FeatureBodySegments
+	if *compression {
+		f |= hps.FeatureZstd | hps.FeatureGzip | hps.FeatureDeflate | hps.FeatureCompactHeaders
+	}
+	return hps.Capabilities{Version: hps.ProtocolVersion, Features: f}
+}
+
+// addCapabilitiesCharacteristic advertises the capabilities, in plain text
+// as they are read before the key exchange
+func addCapabilitiesCharacteristic(s *gatt.Service) {
+	s.AddCharacteristic(gatt.MustParseUUID(hps.CapabilitiesID)).HandleReadFunc(
+		func(rsp gatt.ResponseWriter, req *gatt.ReadRequest) {
+			if _, err := rsp.Write(capabilities().Encode()); err != nil {
+				log.Printf("Error: Read capabilities %v", err)
+			}
+		})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+func TestCapabilities(t *testing.T) {
+	defer func(c bool) { *compression = c }(*compression)
+
+	*compression = true
+	c := capabilities()
+	if c.Version != hps.ProtocolVersion || !c.Has(hps.FeatureBodySegments|hps.FeatureGzip|hps.FeatureCompactHeaders) {
+		t.Errorf("got %+v", c)
+	}
+	*compression = false
+	if c := capabilities(); c.Has(hps.FeatureGzip) || !c.Has(hps.FeatureEncryption) {
+		t.Errorf("without compression: got %+v", c)
+	}
+}
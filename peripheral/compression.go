@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+// encodeBody compresses a response body over the BLE link with an encoding
+// the central accepts, if that makes it smaller, setting the link header
+func encodeBody(accept string, h http.Header, body []byte) []byte {
+	if accept == "" || !*compression {
+		return body
+	}
+
+	// Leave bodies the upstream compressed as they are
+	encoding := hps.NegotiateEncoding(accept)
+	if encoding == "" || len(body) == 0 || h.Get("Content-Encoding") != "" {
+		return body
+	}
+	b, err := hps.Encode(encoding, body)
+	if err != nil || len(b) >= len(body) {
+		return body
+	}
+	h.Set(hps.ContentEncodingHeader, encoding)
+	h.Set("Content-Length", strconv.Itoa(len(b)))
+	return b
+}
+
+// encodeHeaders encodes the response headers, compact if the central asked
+func encodeHeaders(link hps.LinkHeaders, h http.Header) ([]byte, bool) {
+	if link.HeaderEncoding == hps.CompactHeaderEncoding && *compression {
+		return hps.EncodeCompactHeaders(h)
+	}
+	return hps.EncodeHeaders(h)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+func TestEncodeBody(t *testing.T) {
+	body := []byte(strings.Repeat(`{"on":true}`, 50))
+
+	h := http.Header{}
+	b := encodeBody("deflate, gzip", h, body)
+	if h.Get(hps.ContentEncodingHeader) != "deflate" {
+		t.Errorf("headers: got %v", h)
+	}
+	if d, err := hps.Decode("deflate", b); err != nil || !bytes.Equal(d, body) {
+		t.Errorf("body: got %q, err: %v", d, err)
+	}
+
+	// The central didn't negotiate
+	h = http.Header{}
+	if b := encodeBody("", h, body); !bytes.Equal(b, body) || len(h) != 0 {
+		t.Errorf("not negotiated: got %v", h)
+	}
+
+	// Already compressed by the upstream
+	h = http.Header{"Content-Encoding": {"br"}}
+	if b := encodeBody("gzip", h, body); !bytes.Equal(b, body) || h.Get(hps.ContentEncodingHeader) != "" {
+		t.Errorf("upstream encoded: got %v", h)
+	}
+}
+
+func TestEncodeHeaders(t *testing.T) {
+	h := http.Header{"Content-Type": {"application/json"}}
+	if b, _ := encodeHeaders(hps.LinkHeaders{HeaderEncoding: hps.CompactHeaderEncoding}, h); !hps.IsCompactHeaders(b) {
+		t.Errorf("compact: got %q", b)
+	}
+	if b, _ := encodeHeaders(hps.LinkHeaders{}, h); string(b) != "Content-Type=application/json" {
+		t.Errorf("text: got %q", b)
+	}
+}
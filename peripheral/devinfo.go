@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+// version is set when building a release, eg:
+//
+//	go build -ldflags "-X main.version=v1.4.0"
+var version string
+
+// deviceInfo fills in the Device Information Service values that weren't
+// configured, from the machine ID & build info
+func deviceInfo(info hps.DeviceInfo) hps.DeviceInfo {
+	if info.Serial == "" {
+		info.Serial = serialNumber("/etc/machine-id")
+	}
+	if info.HardwareRevision == "" {
+		// Set on Raspberry Pi & other device tree boards
+		if b, err := ioutil.ReadFile("/proc/device-tree/model"); err == nil {
+			info.HardwareRevision = strings.TrimRight(string(b), "\x00\n")
+		}
+	}
+	software, firmware := buildVersions()
+	if info.SoftwareRevision == "" {
+		info.SoftwareRevision = software
+	}
+	if info.FirmwareRevision == "" {
+		info.FirmwareRevision = firmware
+	}
+	return info
+}
+
+// serialNumber derives a stable serial number from the machine ID. The
+// machine ID itself should not be exposed, so like
+// sd_id128_get_machine_app_specific it is hashed with an application ID.
+func serialNumber(machineIDFile string) string {
+	b, err := ioutil.ReadFile(machineIDFile)
+	if err != nil {
+		return ""
+	}
+	id := strings.TrimSpace(string(b))
+	if id == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(id))
+	mac.Write([]byte(hps.PeripheralID))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// buildVersions returns the btserver version as the software revision, and
+// the Go & BLE library versions as the firmware revision
+func buildVersions() (software, firmware string) {
+	software = version
+	firmware = runtime.Version()
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return software, firmware
+	}
+	if software == "" {
+		software = bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == "github.com/paypal/gatt" {
+			firmware += " gatt " + dep.Version
+		}
+	}
+	return software, firmware
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+var testDeviceInfo = hps.DeviceInfo{Manufacturer: "davidoram", Model: "btserver", Serial: "configured"}
+
+func TestSerialNumber(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "machine-id")
+	id := "4c6f1d3a0e8b4f6d9a2c7b5e1f0a3d8c"
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := serialNumber(path)
+	if len(s) != 16 || strings.Contains(id, s) {
+		t.Errorf("serial: got %q, want 16 hex digits not revealing the machine ID", s)
+	}
+	if again := serialNumber(path); again != s {
+		t.Errorf("serial not stable: got %q then %q", s, again)
+	}
+	if s := serialNumber(filepath.Join(t.TempDir(), "missing")); s != "" {
+		t.Errorf("missing machine ID: got %q", s)
+	}
+}
+
+func TestDeviceInfoDefaults(t *testing.T) {
+	info := deviceInfo(testDeviceInfo)
+	if info.Serial != "configured" || !strings.HasPrefix(info.FirmwareRevision, "go") {
+		t.Errorf("got %+v", info)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// globMatch reports whether s matches pattern, where '*' matches any run of
+// characters, including '/'
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// hostMatch reports whether host matches pattern label by label, ignoring
+// case. A '*' matches within a single label, so '*.example.com' matches
+// 'api.example.com' but not 'example.com', 'a.b.example.com' or
+// 'example.com.evil.org'. A pattern of just '*' matches any host.
+func hostMatch(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pl := strings.Split(strings.ToLower(pattern), ".")
+	hl := strings.Split(strings.ToLower(host), ".")
+	if len(pl) != len(hl) {
+		return false
+	}
+	for i := range pl {
+		if !globMatch(pl[i], hl[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// urlPattern matches the host, port & path of a URL, each on its own, so a
+// wildcard in one can't match text from another. It is parsed from
+// '{host}[:{port}][/{path}]', eg '*.example.com/v1/*'. The host is matched
+// by hostMatch, the port and path by globMatch. Any port matches if there is
+// none in the pattern, and any path if there is no path.
+type urlPattern struct {
+	host, port, path string
+}
+
+func parseURLPattern(s string) urlPattern {
+	var p urlPattern
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s, p.path = s[:i], s[i:]
+	}
+	// The port follows the last ':', unless it is within an IPv6 address
+	if i := strings.LastIndexByte(s, ':'); i >= 0 && i > strings.LastIndexByte(s, ']') {
+		s, p.port = s[:i], s[i+1:]
+	}
+	p.host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	return p
+}
+
+func (p urlPattern) match(u *url.URL) bool {
+	if !hostMatch(p.host, u.Hostname()) {
+		return false
+	}
+	if p.port != "" && !globMatch(p.port, u.Port()) {
+		return false
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return p.path == "" || globMatch(p.path, path)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+var globTests = []struct {
+	pattern string
+	s       string
+	match   bool
+}{
+	{"api.example.com/v1", "api.example.com/v1", true},
+	{"api.example.com/v1", "api.example.com/v2", false},
+	{"api.example.com/*", "api.example.com/v1/config", true},
+	{"*.example.com/*", "api.example.com/v1", true},
+	{"*.example.com/*", "example.org/v1", false},
+	{"*", "anything", true},
+	{"*/config/*.json", "host:8100/config/flags.json", true},
+	{"*/config/*.json", "host:8100/config/flags.yaml", false},
+	{"a*a", "a", false},
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tt := range globTests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.match {
+			t.Errorf("globMatch(%q, %q): got %t, want %t", tt.pattern, tt.s, got, tt.match)
+		}
+	}
+}
+
+var hostTests = []struct {
+	pattern string
+	host    string
+	match   bool
+}{
+	{"api.example.com", "api.example.com", true},
+	{"api.example.com", "API.Example.com", true},
+	{"*.example.com", "api.example.com", true},
+	{"*.example.com", "example.com", false},
+	{"*.example.com", "a.b.example.com", false},
+	{"*.example.com", "example.com.evil.org", false},
+	{"api-*.example.com", "api-eu.example.com", true},
+	{"localhost*", "localhost", true},
+	{"localhost*", "localhost.attacker.com", false},
+	{"*", "anything.example.com", true},
+}
+
+func TestHostMatch(t *testing.T) {
+	for _, tt := range hostTests {
+		if got := hostMatch(tt.pattern, tt.host); got != tt.match {
+			t.Errorf("hostMatch(%q, %q): got %t, want %t", tt.pattern, tt.host, got, tt.match)
+		}
+	}
+}
+
+var urlPatternTests = []struct {
+	pattern string
+	url     string
+	match   bool
+}{
+	{"api.example.com/*", "http://api.example.com/v1/config", true},
+	{"api.example.com/*", "http://api.example.com", true},
+	{"api.example.com", "http://api.example.com/v1/config", true},
+	{"*.example.com/*", "http://api.example.com:8100/v1", true},
+	{"*.example.com/*", "http://evil.com/x.example.com/steal", false},
+	{"*.example.com/v1/*", "http://api.example.com/v2/v1/x", false},
+	{"localhost:8100/*", "http://localhost:8100/config", true},
+	{"localhost:8100/*", "http://localhost:8200/config", false},
+	{"[::1]:*", "http://[::1]:8100/config", true},
+	{"*/config/*.json", "http://host:8100/config/flags.json", true},
+	{"*/config/*.json", "http://host:8100/config/flags.yaml", false},
+}
+
+func TestURLPattern(t *testing.T) {
+	for _, tt := range urlPatternTests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parseURLPattern(tt.pattern).match(u); got != tt.match {
+			t.Errorf("%q match %q: got %t, want %t", tt.pattern, tt.url, got, tt.match)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+// histogram is a Prometheus style histogram, with cumulative buckets
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// counterVec is a counter, partitioned by the values of its labels
+type counterVec struct {
+	labels []string
+	values map[string]uint64
+	keys   map[string][]string
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: map[string]uint64{}, keys: map[string][]string{}}
+}
+
+func (c *counterVec) inc(values ...string) {
+	k := fmt.Sprintf("%q", values)
+	c.values[k]++
+	c.keys[k] = values
+}
+
+func (c *counterVec) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	ks := make([]string, 0, len(c.values))
+	for k := range c.values {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		fmt.Fprintf(w, "%s{", name)
+		for i, l := range c.labels {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, "%s=%q", l, c.keys[k][i])
+		}
+		fmt.Fprintf(w, "} %d\n", c.values[k])
+	}
+}
+
+// metrics are served in the Prometheus text format on /metrics
+type metrics struct {
+	mu                  sync.Mutex
+	connectedCentrals   int
+	advertising         bool
+	transactions        *counterVec
+	truncations         *counterVec
+	decodeErrors        *counterVec
+	notifyFailures      uint64
+	upstreamLatency     *histogram
+	requestBodyBytes    *histogram
+	responseBodyBytes   *histogram
+	responseHeaderBytes *histogram
+}
+
+func newMetrics() *metrics {
+	sizes := []float64{0, 64, 128, 256, 512, 1024, 4096, 16384, 65536}
+	return &metrics{
+		transactions:        newCounterVec("method", "status"),
+		truncations:         newCounterVec("part"),
+		decodeErrors:        newCounterVec("type"),
+		upstreamLatency:     newHistogram(0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+		requestBodyBytes:    newHistogram(sizes...),
+		responseBodyBytes:   newHistogram(sizes...),
+		responseHeaderBytes: newHistogram(0, 64, 128, 256, 384, float64(hps.HeaderMaxOctets)),
+	}
+}
+
+func (m *metrics) centralConnected(delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connectedCentrals += delta
+}
+
+func (m *metrics) setAdvertising(advertising bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advertising = advertising
+}
+
+func (m *metrics) notifyFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifyFailures++
+}
+
+// decodeError counts errors decoding the control point
+func (m *metrics) decodeError(err error) {
+	var methodErr *hps.DecodeHttpMethodError
+	var schemeErr *hps.DecodeURLSchemeError
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case errors.As(err, &methodErr):
+		m.decodeErrors.inc("DecodeHttpMethodError")
+	case errors.As(err, &schemeErr):
+		m.decodeErrors.inc("DecodeURLSchemeError")
+	default:
+		m.decodeErrors.inc("other")
+	}
+}
+
+func (m *metrics) transaction(t *transaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transactions.inc(t.Request.Method, strconv.Itoa(t.NotifyStatus.StatusCode))
+	if t.NotifyStatus.HeadersTruncated {
+		m.truncations.inc("headers")
+	}
+	if t.NotifyStatus.BodyTruncated {
+		m.truncations.inc("body")
+	}
+	if t.Upstream > 0 {
+		m.upstreamLatency.observe(t.Upstream.Seconds())
+	}
+	m.requestBodyBytes.observe(float64(len(t.Request.Body)))
+	m.responseBodyBytes.observe(float64(len(t.Body)))
+	m.responseHeaderBytes.observe(float64(len(t.Headers)))
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP btserver_connected_centrals Number of connected centrals\n# TYPE btserver_connected_centrals gauge\n")
+	fmt.Fprintf(w, "btserver_connected_centrals %d\n", m.connectedCentrals)
+	advertising := 0
+	if m.advertising {
+		advertising = 1
+	}
+	fmt.Fprintf(w, "# HELP btserver_advertising Whether the HPS service is being advertised\n# TYPE btserver_advertising gauge\n")
+	fmt.Fprintf(w, "btserver_advertising %d\n", advertising)
+	m.transactions.write(w, "btserver_transactions_total", "HPS transactions by method and status")
+	m.truncations.write(w, "btserver_truncations_total", "Responses truncated to fit the HPS characteristics")
+	m.decodeErrors.write(w, "btserver_decode_errors_total", "Control point writes that could not be decoded")
+	fmt.Fprintf(w, "# HELP btserver_notify_failures_total Status notifications that could not be sent\n# TYPE btserver_notify_failures_total counter\n")
+	fmt.Fprintf(w, "btserver_notify_failures_total %d\n", m.notifyFailures)
+	m.upstreamLatency.write(w, "btserver_upstream_latency_seconds", "Latency of upstream HTTP calls")
+	m.requestBodyBytes.write(w, "btserver_request_body_bytes", "Size of request bodies written by centrals")
+	m.responseBodyBytes.write(w, "btserver_response_body_bytes", "Size of upstream response bodies")
+	m.responseHeaderBytes.write(w, "btserver_response_header_bytes", "Size of encoded response headers")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(0.1, 1)
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.observe(v)
+	}
+	var b bytes.Buffer
+	h.write(&b, "latency_seconds", "Latency")
+	want := `# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 2.65
+latency_seconds_count 4
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("method", "status")
+	c.inc("GET", "200")
+	c.inc("POST", "502")
+	c.inc("GET", "200")
+	var b bytes.Buffer
+	c.write(&b, "requests_total", "Requests")
+	want := `# HELP requests_total Requests
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 2
+requests_total{method="POST",status="502"} 1
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := newMetrics()
+	m.centralConnected(2)
+	m.centralConnected(-1)
+	m.setAdvertising(true)
+	m.notifyFailure()
+	m.decodeError(&hps.DecodeHttpMethodError{})
+	m.transaction(&transaction{
+		Response: &hps.Response{
+			NotifyStatus: hps.NotifyStatus{StatusCode: 200, BodyTruncated: true},
+			Headers:      []byte("Content-Type=text/plain"),
+			Body:         []byte(strings.Repeat("a", 100)),
+		},
+		Request:  savedRequest{Method: "GET"},
+		Upstream: 30 * time.Millisecond,
+	})
+
+	s := httptest.NewServer(m)
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type: got %q", ct)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	for _, line := range []string{
+		"# TYPE btserver_connected_centrals gauge",
+		"btserver_connected_centrals 1",
+		"btserver_advertising 1",
+		`btserver_transactions_total{method="GET",status="200"} 1`,
+		`btserver_truncations_total{part="body"} 1`,
+		`btserver_decode_errors_total{type="DecodeHttpMethodError"} 1`,
+		"btserver_notify_failures_total 1",
+		`btserver_upstream_latency_seconds_bucket{le="0.025"} 0`,
+		`btserver_upstream_latency_seconds_bucket{le="0.05"} 1`,
+		"btserver_upstream_latency_seconds_count 1",
+		`btserver_response_body_bytes_bucket{le="64"} 0`,
+		`btserver_response_body_bytes_bucket{le="128"} 1`,
+		`btserver_response_header_bytes_bucket{le="64"} 1`,
+		"btserver_request_body_bytes_sum 0",
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, b)
+		}
+	}
+}
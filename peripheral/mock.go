@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mockFixtures answers upstream calls from canned responses, without making
+// network calls. Fixtures are matched in order, eg:
+//
+//	fixtures:
+//	  - method: GET
+//	    url: "http://localhost:8100/config/*"
+//	    headers:
+//	      Accept: "application/json*"
+//	    response:
+//	      status: 200
+//	      headers:
+//	        Content-Type: application/json
+//	      body: '{"interval": 60}'
+//	      delay: 250ms
+//	  - url: "*/firmware.bin"
+//	    response:
+//	      status: 200
+//	      body_file: firmware.bin
+//	      truncate_body: true
+type mockFixtures struct {
+	Fixtures []mockFixture `yaml:"fixtures"`
+}
+
+type mockFixture struct {
+	// Method is optional, URL is a pattern matched against the full URL, and
+	// Headers are patterns matched against the request header values
+	Method   string            `yaml:"method"`
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Response mockResponse      `yaml:"response"`
+}
+
+type mockResponse struct {
+	Status   int               `yaml:"status"`
+	Headers  map[string]string `yaml:"headers"`
+	Body     string            `yaml:"body"`
+	BodyFile string            `yaml:"body_file"`
+	Delay    time.Duration     `yaml:"delay"`
+
+	// Force the truncation flags reported to the central
+	TruncateHeaders bool `yaml:"truncate_headers"`
+	TruncateBody    bool `yaml:"truncate_body"`
+}
+
+// truncation lets an upstream response force the truncation flags
+type truncation interface {
+	Truncated() (headers, body bool)
+}
+
+type mockBody struct {
+	*bytes.Reader
+	headers, body bool
+}
+
+func (b *mockBody) Close() error                    { return nil }
+func (b *mockBody) Truncated() (headers, body bool) { return b.headers, b.body }
+
+func loadMockFixtures(path string) (*mockFixtures, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m mockFixtures
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("Invalid fixtures file '%s', err: %v", path, err)
+	}
+	// Load bodies up front, relative to the fixtures file
+	for i, f := range m.Fixtures {
+		if f.URL == "" {
+			return nil, fmt.Errorf("Invalid fixture %d in '%s', url is required", i, path)
+		}
+		if f.Response.Status == 0 {
+			m.Fixtures[i].Response.Status = http.StatusOK
+		}
+		if f.Response.BodyFile != "" {
+			bf := f.Response.BodyFile
+			if !filepath.IsAbs(bf) {
+				bf = filepath.Join(filepath.Dir(path), bf)
+			}
+			body, err := ioutil.ReadFile(bf)
+			if err != nil {
+				return nil, err
+			}
+			m.Fixtures[i].Response.Body = string(body)
+		}
+	}
+	return &m, nil
+}
+
+func (f mockFixture) matches(req *http.Request) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, req.Method) {
+		return false
+	}
+	if !globMatch(f.URL, req.URL.String()) {
+		return false
+	}
+	for name, pattern := range f.Headers {
+		if !globMatch(pattern, req.Header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// RoundTrip implements http.RoundTripper
+func (m *mockFixtures) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	for _, f := range m.Fixtures {
+		if !f.matches(req) {
+			continue
+		}
+		r := f.Response
+		if r.Delay > 0 {
+			select {
+			case <-time.After(r.Delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+		h := http.Header{}
+		for name, value := range r.Headers {
+			h.Set(name, value)
+		}
+		h.Set("Content-Length", strconv.Itoa(len(r.Body)))
+		return &http.Response{
+			Status:        strconv.Itoa(r.Status) + " " + http.StatusText(r.Status),
+			StatusCode:    r.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        h,
+			Body:          &mockBody{Reader: bytes.NewReader([]byte(r.Body)), headers: r.TruncateHeaders, body: r.TruncateBody},
+			ContentLength: int64(len(r.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("No fixture matches %s %s", req.Method, req.URL.String())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testFixtures = `
+fixtures:
+  - method: GET
+    url: "http://localhost:8100/config/*"
+    headers:
+      Accept: "application/json*"
+    response:
+      headers:
+        Content-Type: application/json
+      body: '{"interval": 60}'
+      delay: 10ms
+  - url: "*/firmware.bin"
+    response:
+      status: 206
+      body_file: firmware.bin
+      truncate_body: true
+`
+
+func TestMockFixtures(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fixtures.yaml")
+	if err := ioutil.WriteFile(path, []byte(testFixtures), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "firmware.bin"), []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadMockFixtures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Fixtures[0].Response.Delay != time.Millisecond*10 {
+		t.Errorf("delay: got %v", m.Fixtures[0].Response.Delay)
+	}
+	client := &http.Client{Transport: m}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8100/config/flags", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"interval": 60}` || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("config: got %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+
+	// Header mismatch
+	req.Header.Set("Accept", "text/plain")
+	if _, err := client.Do(req); err == nil {
+		t.Errorf("expected no fixture to match Accept: text/plain")
+	}
+
+	resp, err = client.Do(mustRequest(t, "POST", "http://example.com/fw/firmware.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "0123456789" {
+		t.Errorf("firmware: got %d %q", resp.StatusCode, body)
+	}
+	if tr, ok := resp.Body.(truncation); !ok {
+		t.Errorf("firmware: body does not report truncation")
+	} else if headers, body := tr.Truncated(); headers || !body {
+		t.Errorf("firmware: got truncated headers %t, body %t", headers, body)
+	}
+}
+
+func TestMockFixturesInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures.yaml")
+	if err := ioutil.WriteFile(path, []byte("fixtures:\n  - method: GET\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMockFixtures(path); err == nil {
+		t.Errorf("expected an error for a fixture without a url")
+	}
+	if _, err := loadMockFixtures(filepath.Join(os.TempDir(), "missing", "fixtures.yaml")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func mustRequest(t *testing.T, method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst requests, refilling at rate
+// tokens per second. A rate of zero means unlimited.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if !b.ready(now) {
+		return false
+	}
+	b.take()
+	return true
+}
+
+// ready reports whether a token is available, without taking it
+func (b *tokenBucket) ready(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+func (b *tokenBucket) take() {
+	if b.rate > 0 {
+		b.tokens--
+	}
+}
+
+// full reports whether the bucket has refilled, and so can be discarded
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// limiter caps the rate of requests from each central, the rate across all
+// centrals, and the number of upstream calls in flight
+type limiter struct {
+	mu         sync.Mutex
+	rate       float64
+	burst      int
+	perCentral map[string]*tokenBucket
+	global     *tokenBucket
+	inflight   chan struct{}
+}
+
+func newLimiter(rate float64, burst int, globalRate float64, globalBurst int, maxInflight int) *limiter {
+	l := &limiter{
+		rate:       rate,
+		burst:      burst,
+		perCentral: map[string]*tokenBucket{},
+		global:     newTokenBucket(globalRate, globalBurst, time.Now()),
+	}
+	if maxInflight > 0 {
+		l.inflight = make(chan struct{}, maxInflight)
+	}
+	return l
+}
+
+// admit decides whether a request from the central may go upstream. If so it
+// returns a function to call when the upstream call completes, otherwise it
+// returns the HTTP status to report to the central. Tokens are only taken
+// once every limit has admitted the request, so a rejected request costs the
+// central nothing.
+func (l *limiter) admit(centralID string) (release func(), status int) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.perCentral[centralID]
+	if !ok {
+		// Drop idle buckets, they would be created full anyway
+		for id, other := range l.perCentral {
+			if other.full(now) {
+				delete(l.perCentral, id)
+			}
+		}
+		b = newTokenBucket(l.rate, l.burst, now)
+		l.perCentral[centralID] = b
+	}
+	if !b.ready(now) {
+		return nil, http.StatusTooManyRequests
+	}
+	if !l.global.ready(now) {
+		return nil, http.StatusServiceUnavailable
+	}
+
+	release = func() {}
+	if l.inflight != nil {
+		select {
+		case l.inflight <- struct{}{}:
+			release = func() { <-l.inflight }
+		default:
+			return nil, http.StatusServiceUnavailable
+		}
+	}
+	b.take()
+	l.global.take()
+	return release, 0
+}
+
+// load is the percentage of the in-flight limit in use, always 0 if there
+// is no limit
+func (l *limiter) load() uint8 {
+	if l == nil || l.inflight == nil {
+		return 0
+	}
+	return uint8(len(l.inflight) * 100 / cap(l.inflight))
+}
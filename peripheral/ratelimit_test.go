@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(1, 2, now)
+	for i, want := range []bool{true, true, false} {
+		if got := b.allow(now); got != want {
+			t.Errorf("request %d: got %t, want %t", i, got, want)
+		}
+	}
+	if !b.allow(now.Add(time.Second)) {
+		t.Errorf("got false after refill, want true")
+	}
+	if b.full(now.Add(time.Second)) {
+		t.Errorf("got full, want not full")
+	}
+	if !b.full(now.Add(time.Minute)) {
+		t.Errorf("got not full, want full")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(0, 0, 0, 0, 1)
+	release, code := l.admit("a")
+	if code != 0 {
+		t.Fatalf("got %d, want 0", code)
+	}
+	if _, code := l.admit("b"); code != http.StatusServiceUnavailable {
+		t.Errorf("in flight: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	release()
+	if _, code := l.admit("b"); code != 0 {
+		t.Errorf("after release: got %d, want 0", code)
+	}
+
+	l = newLimiter(1, 1, 0, 0, 0)
+	l.admit("a")
+	if _, code := l.admit("a"); code != http.StatusTooManyRequests {
+		t.Errorf("per central: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if _, code := l.admit("b"); code != 0 {
+		t.Errorf("other central: got %d, want 0", code)
+	}
+
+	l = newLimiter(0, 0, 1, 1, 0)
+	l.admit("a")
+	if _, code := l.admit("b"); code != http.StatusServiceUnavailable {
+		t.Errorf("global: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestLimiterRejectionCostsNothing(t *testing.T) {
+	// The global bucket rejects b, which keeps its own token
+	l := newLimiter(1, 1, 1, 1, 0)
+	l.admit("a")
+	if _, code := l.admit("b"); code != http.StatusServiceUnavailable {
+		t.Fatalf("global: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if b := l.perCentral["b"]; b.tokens != 1 {
+		t.Errorf("central b: got %v tokens, want 1", b.tokens)
+	}
+
+	// The in-flight cap rejects a, which keeps its tokens
+	l = newLimiter(1, 1, 1, 2, 1)
+	release, _ := l.admit("b")
+	if _, code := l.admit("a"); code != http.StatusServiceUnavailable {
+		t.Fatalf("in flight: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	release()
+	if _, code := l.admit("a"); code != 0 {
+		t.Errorf("after release: got %d, want 0", code)
+	}
+}
+
+func TestRejectionOnlyReachesRejectedCentral(t *testing.T) {
+	resetShutdown(t)
+	defer func(l *limiter) { limits = l }(limits)
+	limits = newLimiter(1, 1, 0, 0, 0)
+	gateway.connect(testCentral{id: "flood"})
+
+	other := &transaction{Response: &hps.Response{NotifyStatus: hps.NotifyStatus{StatusCode: http.StatusOK}}}
+	setResponse("central", other)
+
+	flood := savedRequest{CentralID: "flood", Method: "GET", URI: "http://example.com/"}
+	release, ok := admitRequest(flood)
+	if !ok {
+		t.Fatal("first request rejected")
+	}
+	release()
+	upstreamCalls.Done()
+	if _, ok := admitRequest(flood); ok {
+		t.Fatal("second request admitted, want rejected")
+	}
+
+	if got := currentResponse(testCentral{id: "flood"}); got == nil || got.NotifyStatus.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("flooding central: got %+v, want status %d", got, http.StatusTooManyRequests)
+	}
+	if got := currentResponse(testCentral{id: "central"}); got != other {
+		t.Errorf("other central: got %+v, want its own response", got)
+	}
+}
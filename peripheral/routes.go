@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// routeTable maps the logical URIs written by centrals to upstream URLs, so
+// centrals send fewer bytes over BLE, and backends can move without
+// reflashing devices. The longest matching prefix wins, eg:
+//
+//	routes:
+//	  - prefix: /telemetry
+//	    upstream: https://ingest.example.com/v2/telemetry
+//	    timeout: 5s
+//	    tls:
+//	      ca: ca.pem
+//	      cert: client.pem
+//	      key: client-key.pem
+//	  - prefix: svc://config/
+//	    upstream: http://config.internal:8080/
+//
+// A central writing '/telemetry/42' is sent to
+// 'https://ingest.example.com/v2/telemetry/42'.
+type routeTable struct {
+	Routes []route `yaml:"routes"`
+}
+
+type route struct {
+	Prefix   string        `yaml:"prefix"`
+	Upstream string        `yaml:"upstream"`
+	Timeout  time.Duration `yaml:"timeout"`
+	TLS      *routeTLS     `yaml:"tls"`
+
+	tlsConfig *tls.Config
+	client    *http.Client
+}
+
+// routeTLS configures the TLS connection to the upstream, file paths are
+// relative to the routes file
+type routeTLS struct {
+	CA                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// routes is the route table, nil if there is none
+var routes *routeTable
+
+func loadRoutes(path string) (*routeTable, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t routeTable
+	if err := yaml.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("Invalid routes file '%s', err: %v", path, err)
+	}
+	for i, r := range t.Routes {
+		if r.Prefix == "" {
+			return nil, fmt.Errorf("Invalid route %d in '%s', prefix is required", i, path)
+		}
+		u, err := url.Parse(r.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid route '%s' in '%s', upstream must be an http or https URL", r.Prefix, path)
+		}
+		if r.TLS != nil {
+			t.Routes[i].tlsConfig, err = r.TLS.config(filepath.Dir(path))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid route '%s' in '%s', err: %v", r.Prefix, path, err)
+			}
+		}
+	}
+	return &t, nil
+}
+
+func (c *routeTLS) config(dir string) (*tls.Config, error) {
+	abs := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	cfg := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(abs(c.CA))
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(abs(c.Cert), abs(c.Key))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// connect sets the client each route calls its upstream with. Routes with
+// TLS settings get their own copy of the base transport, still sharing its
+// proxy settings.
+func (t *routeTable) connect(base *http.Client) {
+	if t == nil {
+		return
+	}
+	for i, r := range t.Routes {
+		t.Routes[i].client = base
+		if tr, ok := base.Transport.(*http.Transport); ok && r.tlsConfig != nil {
+			tr = tr.Clone()
+			tr.TLSClientConfig = r.tlsConfig
+			t.Routes[i].client = &http.Client{Transport: tr}
+		}
+	}
+}
+
+// resolve returns the route for the URI written by the central, and the
+// upstream URL it maps to
+func (t *routeTable) resolve(uri string) (*route, string, bool) {
+	if t == nil {
+		return nil, "", false
+	}
+	var best *route
+	for i, r := range t.Routes {
+		if !strings.HasPrefix(uri, r.Prefix) {
+			continue
+		}
+		// '/telemetry' matches '/telemetry/42' but not '/telemetryx'
+		rest := uri[len(r.Prefix):]
+		if rest != "" && !strings.HasSuffix(r.Prefix, "/") && rest[0] != '/' && rest[0] != '?' {
+			continue
+		}
+		if best == nil || len(r.Prefix) > len(best.Prefix) {
+			best = &t.Routes[i]
+		}
+	}
+	if best == nil {
+		return nil, "", false
+	}
+	rest := uri[len(best.Prefix):]
+	if strings.HasSuffix(best.Upstream, "/") {
+		rest = strings.TrimPrefix(rest, "/")
+	} else if rest != "" && rest[0] != '/' && rest[0] != '?' {
+		rest = "/" + rest
+	}
+	return best, best.Upstream + rest, true
+}
+
+// isLogicalURI reports whether the central wrote a logical URI, such as
+// '/telemetry' or 'svc://config/flags', rather than a host and path
+func isLogicalURI(uri string) bool {
+	return strings.HasPrefix(uri, "/") || strings.Contains(uri, "://")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRoutes = `
+routes:
+  - prefix: /telemetry
+    upstream: https://ingest.example.com/v2/telemetry
+    timeout: 5s
+    tls:
+      server_name: ingest.internal
+  - prefix: /telemetry/bulk
+    upstream: https://bulk.example.com/
+  - prefix: svc://config/
+    upstream: http://config.internal:8080/api
+`
+
+var resolveTests = []struct {
+	uri string
+	url string
+	ok  bool
+}{
+	{"/telemetry", "https://ingest.example.com/v2/telemetry", true},
+	{"/telemetry/42", "https://ingest.example.com/v2/telemetry/42", true},
+	{"/telemetry?id=42", "https://ingest.example.com/v2/telemetry?id=42", true},
+	{"/telemetry/bulk/7", "https://bulk.example.com/7", true},
+	{"/telemetryx", "", false},
+	{"svc://config/flags", "http://config.internal:8080/api/flags", true},
+	{"svc://other/flags", "", false},
+	{"localhost:8100/hello.txt", "", false},
+}
+
+func TestRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := ioutil.WriteFile(path, []byte(testRoutes), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := loadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range resolveTests {
+		_, u, ok := rt.resolve(tt.uri)
+		if ok != tt.ok || u != tt.url {
+			t.Errorf("resolve(%q): got %q %t, want %q %t", tt.uri, u, ok, tt.url, tt.ok)
+		}
+	}
+
+	r, _, _ := rt.resolve("/telemetry/42")
+	if r.Timeout != time.Second*5 || r.tlsConfig == nil || r.tlsConfig.ServerName != "ingest.internal" {
+		t.Errorf("route settings: got %v %v", r.Timeout, r.tlsConfig)
+	}
+
+	// Only the route with TLS settings gets its own client
+	base := newUpstreamClient(&upstreamProxies{})
+	rt.connect(base)
+	if r.client == base || r.client.Transport.(*http.Transport).TLSClientConfig != r.tlsConfig {
+		t.Errorf("expected a client with the route's TLS settings")
+	}
+	if r, _, _ := rt.resolve("svc://config/flags"); r.client != base {
+		t.Errorf("expected the shared client")
+	}
+
+	var none *routeTable
+	if _, _, ok := none.resolve("/telemetry"); ok {
+		t.Errorf("expected no route")
+	}
+}
+
+func TestRoutesInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := ioutil.WriteFile(path, []byte("routes:\n  - prefix: /x\n    upstream: ftp://example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRoutes(path); err == nil {
+		t.Errorf("expected an error for an ftp upstream")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// headerRules add, replace or remove headers on upstream calls, so that API
+// keys & the like live on the gateway rather than the centrals. Every rule
+// whose pattern matches the URL is applied, in order, see urlPattern. A rule
+// with https set only applies to https URLs, so its secrets are never sent
+// in plain text, eg:
+//
+//	secrets: secrets.yaml
+//	rules:
+//	  - match: "api.example.com/*"
+//	    https: true
+//	    request:
+//	      set:
+//	        X-API-KEY: "${secret:api_key}"
+//	        User-Agent: btserver
+//	      remove: [Cookie]
+//	    response:
+//	      remove: [Server, Set-Cookie]
+//
+// Header values may refer to entries in the secrets file, a YAML map of
+// names to values, as ${secret:name}. Any other '$' is kept as is.
+type headerRules struct {
+	Secrets string       `yaml:"secrets"`
+	Rules   []headerRule `yaml:"rules"`
+}
+
+type headerRule struct {
+	Match    string       `yaml:"match"`
+	HTTPS    bool         `yaml:"https"`
+	Request  headerAction `yaml:"request"`
+	Response headerAction `yaml:"response"`
+
+	pattern urlPattern
+}
+
+// applies reports whether the rule applies to the upstream call
+func (rule headerRule) applies(req *http.Request) bool {
+	if rule.HTTPS && req.URL.Scheme != "https" {
+		return false
+	}
+	return rule.pattern.match(req.URL)
+}
+
+// headerAction removes headers, then replaces, then adds
+type headerAction struct {
+	Remove []string          `yaml:"remove"`
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+}
+
+// rules are the header rules, nil if there are none
+var rules *headerRules
+
+func loadHeaderRules(path string) (*headerRules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r headerRules
+	if err := yaml.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("Invalid rules file '%s', err: %v", path, err)
+	}
+
+	secrets := map[string]string{}
+	if r.Secrets != "" {
+		sf := r.Secrets
+		if !filepath.IsAbs(sf) {
+			sf = filepath.Join(filepath.Dir(path), sf)
+		}
+		b, err := ioutil.ReadFile(sf)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(b, &secrets); err != nil {
+			return nil, fmt.Errorf("Invalid secrets file '%s', err: %v", sf, err)
+		}
+	}
+
+	// Expand secrets once, so a missing secret is reported at startup
+	for i, rule := range r.Rules {
+		if rule.Match == "" {
+			return nil, fmt.Errorf("Invalid rule %d in '%s', match is required", i, path)
+		}
+		r.Rules[i].pattern = parseURLPattern(rule.Match)
+		for _, a := range []headerAction{rule.Request, rule.Response} {
+			for _, values := range []map[string]string{a.Set, a.Add} {
+				for name, value := range values {
+					v, err := expandSecrets(value, secrets)
+					if err != nil {
+						return nil, fmt.Errorf("Invalid rule %d header %s in '%s', err: %v", i, name, path, err)
+					}
+					values[name] = v
+				}
+			}
+		}
+	}
+	return &r, nil
+}
+
+const secretPrefix = "${secret:"
+
+// expandSecrets replaces the ${secret:name} references in s
+func expandSecrets(s string, secrets map[string]string) (string, error) {
+	var b strings.Builder
+	var missing []string
+	for {
+		i := strings.Index(s, secretPrefix)
+		if i < 0 {
+			break
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated secret reference '%s'", s[i:])
+		}
+		name := s[i+len(secretPrefix) : i+end]
+		v, ok := secrets[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		b.WriteString(s[:i])
+		b.WriteString(v)
+		s = s[i+end+1:]
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unknown secrets %v", missing)
+	}
+	b.WriteString(s)
+	return b.String(), nil
+}
+
+func (a headerAction) apply(h http.Header) {
+	for _, name := range a.Remove {
+		h.Del(name)
+	}
+	for name, value := range a.Set {
+		h.Set(name, value)
+	}
+	for name, value := range a.Add {
+		h.Add(name, value)
+	}
+}
+
+// applyRequest rewrites the headers of an upstream request
+func (r *headerRules) applyRequest(req *http.Request) {
+	if r == nil {
+		return
+	}
+	for _, rule := range r.Rules {
+		if rule.applies(req) {
+			rule.Request.apply(req.Header)
+		}
+	}
+}
+
+// applyResponse rewrites the headers of an upstream response, before they
+// are encoded for the central
+func (r *headerRules) applyResponse(req *http.Request, h http.Header) {
+	if r == nil {
+		return
+	}
+	for _, rule := range r.Rules {
+		if rule.applies(req) {
+			rule.Response.apply(h)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+const testRules = `
+secrets: secrets.yaml
+rules:
+  - match: "api.example.com/*"
+    request:
+      set:
+        X-API-KEY: "${secret:api_key}"
+        User-Agent: btserver
+      remove: [Cookie]
+    response:
+      remove: [Server]
+      add:
+        Via: btserver
+  - match: "*"
+    response:
+      remove: [X-Powered-By]
+`
+
+func writeRules(t *testing.T, rules, secrets string) string {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "secrets.yaml"), []byte(secrets), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rules.yaml")
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHeaderRules(t *testing.T) {
+	r, err := loadHeaderRules(writeRules(t, testRules, "api_key: s3cret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := mustRequest(t, "GET", "http://api.example.com/v1/telemetry")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("User-Agent", "sensor")
+	r.applyRequest(req)
+	if got := req.Header.Get("X-API-KEY"); got != "s3cret" {
+		t.Errorf("X-API-KEY: got %q", got)
+	}
+	if got := req.Header.Get("User-Agent"); got != "btserver" {
+		t.Errorf("User-Agent: got %q", got)
+	}
+	if got := req.Header.Get("Cookie"); got != "" {
+		t.Errorf("Cookie: got %q", got)
+	}
+
+	h := http.Header{"Server": {"nginx"}, "X-Powered-By": {"php"}, "Via": {"1.1 proxy"}}
+	r.applyResponse(req, h)
+	if h.Get("Server") != "" || h.Get("X-Powered-By") != "" {
+		t.Errorf("response headers not removed: %v", h)
+	}
+	if got := h.Values("Via"); len(got) != 2 {
+		t.Errorf("Via: got %v", got)
+	}
+
+	// Only the catch all rule applies
+	other := mustRequest(t, "GET", "http://other.example.com/")
+	other.Header.Set("Cookie", "session=1")
+	r.applyRequest(other)
+	if other.Header.Get("Cookie") == "" || other.Header.Get("X-API-KEY") != "" {
+		t.Errorf("other: got %v", other.Header)
+	}
+
+	// No rules
+	var none *headerRules
+	none.applyRequest(other)
+	none.applyResponse(other, h)
+}
+
+func TestHeaderRulesMissingSecret(t *testing.T) {
+	if _, err := loadHeaderRules(writeRules(t, testRules, "other: value\n")); err == nil {
+		t.Errorf("expected an error for an unknown secret")
+	}
+}
+
+func TestExpandSecrets(t *testing.T) {
+	secrets := map[string]string{"api_key": "s3cret", "user": "gateway"}
+	tests := []struct {
+		value, want string
+		valid       bool
+	}{
+		{"${secret:api_key}", "s3cret", true},
+		{"Bearer ${secret:api_key}", "Bearer s3cret", true},
+		{"${secret:user}:${secret:api_key}", "gateway:s3cret", true},
+		{"price=$5", "price=$5", true},
+		{"$api_key ${api_key} $$", "$api_key ${api_key} $$", true},
+		{"${secret:missing}", "", false},
+		{"${secret:api_key", "", false},
+	}
+	for _, tt := range tests {
+		got, err := expandSecrets(tt.value, secrets)
+		if valid := err == nil; valid != tt.valid || got != tt.want {
+			t.Errorf("%q: got %q, err %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestHeaderRulesExfiltration(t *testing.T) {
+	r, err := loadHeaderRules(writeRules(t, `
+secrets: secrets.yaml
+rules:
+  - match: "*.example.com/*"
+    https: true
+    request:
+      set:
+        X-API-KEY: "${secret:api_key}"
+`, "api_key: s3cret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		sent bool
+	}{
+		{"https://api.example.com/v1/telemetry", true},
+		// The central picks the host, the pattern must not match the path
+		{"https://evil.com/x.example.com/steal", false},
+		{"https://api.example.com.evil.com/steal", false},
+		// Nor send the key in plain text
+		{"http://api.example.com/v1/telemetry", false},
+	}
+	for _, tt := range tests {
+		req := mustRequest(t, "GET", tt.url)
+		r.applyRequest(req)
+		if sent := req.Header.Get("X-API-KEY") != ""; sent != tt.sent {
+			t.Errorf("%s: got secret sent %t, want %t", tt.url, sent, tt.sent)
+		}
+	}
+}
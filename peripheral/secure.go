@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/davidoram/bluetooth/hps"
+	"github.com/paypal/gatt"
+)
+
+// secureLinks tracks the encryption sessions negotiated with each central
+type secureLinks struct {
+	mu       sync.Mutex
+	psk      []byte
+	required bool
+	sessions map[string]*hps.Session
+	replies  map[string][]byte
+}
+
+func newSecureLinks(psk []byte, required bool) *secureLinks {
+	return &secureLinks{
+		psk:      psk,
+		required: required,
+		sessions: map[string]*hps.Session{},
+		replies:  map[string][]byte{},
+	}
+}
+
+// handshake derives a session from the central's public key, the reply is
+// served on the next read of the key exchange characteristic
+func (l *secureLinks) handshake(c gatt.Central, peer []byte) error {
+	k, err := hps.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	s, err := hps.NewSession(k, peer, l.psk, false)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sessions[c.ID()] = s
+	l.replies[c.ID()] = hps.EncodeHandshakeReply(k, s)
+	return nil
+}
+
+func (l *secureLinks) reply(c gatt.Central) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.replies[c.ID()]
+}
+
+func (l *secureLinks) session(c gatt.Central) *hps.Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sessions[c.ID()]
+}
+
+func (l *secureLinks) forget(c gatt.Central) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, c.ID())
+	delete(l.replies, c.ID())
+}
+
+// open decrypts a value written by the central. Plain text is passed
+// through, unless encryption is required.
+func (l *secureLinks) open(c gatt.Central, u gatt.UUID, b []byte) ([]byte, error) {
+	s := l.session(c)
+	if s == nil {
+		if l.required {
+			return nil, hps.DecryptError
+		}
+		return b, nil
+	}
+	return s.Open(u, b)
+}
+
+// seal encrypts a value for the central, so that it fits in limit octets.
+// Callers fit values to readCapacity, reporting the truncation. A limit
+// within the overhead fits nothing, the value is empty. Plain text is
+// passed through, unless encryption is required, when it is empty too.
+func (l *secureLinks) seal(c gatt.Central, u gatt.UUID, b []byte, limit int) []byte {
+	s := l.session(c)
+	if s == nil {
+		if l.required {
+			log.Printf("Warn: not sending %s to central_id: %s in plain text, encryption is required", u.String(), c.ID())
+			return []byte{}
+		}
+		return b
+	}
+	if limit > 0 && limit <= hps.SealOverhead {
+		log.Printf("Warn: %d octets is too small for an encrypted %s value, the central should exchange the MTU", limit, u.String())
+		return []byte{}
+	}
+	if limit > 0 && len(b)+hps.SealOverhead > limit {
+		log.Printf("Warn: truncating %s value to fit the encrypted read", u.String())
+		b = b[:limit-hps.SealOverhead]
+	}
+	return s.Seal(u, b)
+}
+
+func (l *secureLinks) addCharacteristic(s *gatt.Service) {
+	kc := s.AddCharacteristic(gatt.MustParseUUID(hps.KeyExchangeID))
+	kc.HandleWriteFunc(
+		func(r gatt.Request, data []byte) (status byte) {
+			if len(data) != hps.PublicKeyOctets {
+				log.Printf("Error: key exchange, invalid public key length %d", len(data))
+				return gatt.StatusUnexpectedError
+			}
+			if err := l.handshake(r.Central, data); err != nil {
+				log.Printf("Error: key exchange %v", err)
+				return gatt.StatusUnexpectedError
+			}
+			log.Printf("encrypted link central_id: %s", r.Central.ID())
+			return gatt.StatusSuccess
+		})
+	kc.HandleReadFunc(
+		func(rsp gatt.ResponseWriter, req *gatt.ReadRequest) {
+			b := l.reply(req.Central)
+			if b == nil {
+				log.Printf("Warn: Read key exchange received before handshake")
+				return
+			}
+			if _, err := rsp.Write(b); err != nil {
+				log.Printf("Error: Read key exchange %v", err)
+			}
+		})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/davidoram/bluetooth/hps"
+	"github.com/paypal/gatt"
+)
+
+// testCentral is a connected central, mtu is 23 unless exchanged
+type testCentral struct {
+	id  string
+	mtu int
+}
+
+func (c testCentral) ID() string   { return c.id }
+func (c testCentral) Close() error { return nil }
+func (c testCentral) MTU() int     { return c.mtu }
+
+// encryptedLink returns links with a session for the central
+func encryptedLink(t *testing.T, c gatt.Central) *secureLinks {
+	l := newSecureLinks(nil, false)
+	k, err := hps.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.handshake(c, k.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestSealLimit(t *testing.T) {
+	c := testCentral{id: "central", mtu: 23}
+	l := encryptedLink(t, c)
+	u := gatt.UUID16(hps.HTTPEntityBodyID)
+	b := []byte(strings.Repeat("a", 200))
+
+	// The default MTU leaves no room for the overhead
+	if got := l.seal(c, u, b, c.mtu-1); len(got) != 0 {
+		t.Errorf("MTU 23: got %d octets, want none", len(got))
+	}
+	if got := l.seal(c, u, b, 100); len(got) != 100 {
+		t.Errorf("limit 100: got %d octets", len(got))
+	}
+	if got := l.seal(testCentral{id: "plain"}, u, b, 100); len(got) != 200 {
+		t.Errorf("plain: got %d octets", len(got))
+	}
+}
+
+func TestServedStatus(t *testing.T) {
+	defer func(l *secureLinks) { links = l }(links)
+	c := testCentral{id: "central", mtu: 23}
+	links = encryptedLink(t, c)
+
+	h, _ := hps.EncodeHeaders(http.Header{"Age": {"10"}})
+	tx := &transaction{Response: &hps.Response{NotifyStatus: hps.NotifyStatus{StatusCode: http.StatusOK}, Headers: h}}
+	if ns := servedStatus(tx, c); !ns.HeadersTruncated {
+		t.Errorf("encrypted at MTU 23: got %+v", ns)
+	}
+	links = newSecureLinks(nil, false)
+	if ns := servedStatus(tx, c); ns.HeadersTruncated {
+		t.Errorf("plain at MTU 23: got %+v", ns)
+	}
+}
+
+func TestServedStatusBody(t *testing.T) {
+	defer func(l *secureLinks) { links = l }(links)
+	links = newSecureLinks(nil, false)
+	c := testCentral{id: "central", mtu: 256}
+
+	// No Content-Length, only the flag tells the central there's more
+	body := func(n int) *transaction {
+		return &transaction{Response: &hps.Response{
+			NotifyStatus: hps.NotifyStatus{StatusCode: http.StatusOK, BodyReceived: true},
+			Headers:      []byte{},
+			Body:         []byte(strings.Repeat("a", n)),
+		}}
+	}
+	if ns := servedStatus(body(255), c); ns.BodyTruncated {
+		t.Errorf("255 octets: got %+v", ns)
+	}
+	if ns := servedStatus(body(300), c); !ns.BodyTruncated {
+		t.Errorf("300 octets: got %+v", ns)
+	}
+
+	// Less fits once sealed
+	links = encryptedLink(t, c)
+	if ns := servedStatus(body(240), c); !ns.BodyTruncated {
+		t.Errorf("240 octets encrypted: got %+v", ns)
+	}
+	if ns := servedStatus(body(255-hps.SealOverhead), c); ns.BodyTruncated {
+		t.Errorf("%d octets encrypted: got %+v", 255-hps.SealOverhead, ns)
+	}
+}
+
+// centralSession runs the handshake for the central, returning its end of
+// the session
+func centralSession(t *testing.T, l *secureLinks, c gatt.Central) *hps.Session {
+	k, err := hps.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.handshake(c, k.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	s, err := hps.DecodeHandshakeReply(k, l.reply(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestResponsesPerCentral(t *testing.T) {
+	defer func(l *secureLinks, g *gatewayState, al *accessLogger) {
+		links, gateway, accessLog = l, g, al
+	}(links, gateway, accessLog)
+	links = newSecureLinks(nil, true)
+	gateway = newGatewayState()
+	accessLog = &accessLogger{w: ioutil.Discard}
+	a := testCentral{id: "a", mtu: 256}
+	b := testCentral{id: "b", mtu: 256}
+	eavesdropper := testCentral{id: "c", mtu: 256}
+	for _, c := range []gatt.Central{a, b, eavesdropper} {
+		gateway.connect(c)
+	}
+	sa := centralSession(t, links, a)
+	centralSession(t, links, eavesdropper)
+	defer forgetCentral(a)
+
+	h, _ := hps.EncodeHeaders(http.Header{"Age": {"10"}})
+	setResponse(a.id, &transaction{Response: &hps.Response{
+		NotifyStatus: hps.NotifyStatus{StatusCode: http.StatusOK, HeadersReceived: true, BodyReceived: true},
+		Headers:      h,
+		Body:         []byte("secret"),
+	}})
+
+	// Neither a plain text central, nor another encrypted one, gets a's
+	// response or status
+	for _, c := range []gatt.Central{b, eavesdropper} {
+		if v, tx := headersValue(c, c.MTU()-1); tx != nil || v != nil {
+			t.Errorf("%s: read a's headers %x", c.ID(), v)
+		}
+		if v, _, tx := bodyValue(c, c.MTU()-1); tx != nil || v != nil {
+			t.Errorf("%s: read a's body %x", c.ID(), v)
+		}
+		if v, tx := notification(c, c.MTU()-3); tx != nil || v != nil {
+			t.Errorf("%s: notified of a's status %x", c.ID(), v)
+		}
+	}
+	// Plain text is refused when encryption is required
+	if v := links.seal(b, gatt.UUID16(hps.HTTPEntityBodyID), []byte("secret"), 0); len(v) != 0 {
+		t.Errorf("sealed for b in plain text: %q", v)
+	}
+
+	v, tx := notification(a, a.MTU()-3)
+	if tx == nil {
+		t.Fatal("a not notified")
+	}
+	p, err := sa.Open(gatt.UUID16(hps.HTTPStatusCodeID), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns, _ := hps.DecodeNotifyStatus(p); ns.StatusCode != http.StatusOK {
+		t.Errorf("a: got status %+v", ns)
+	}
+	if v, _ := notification(a, a.MTU()-3); v != nil {
+		t.Errorf("a notified twice")
+	}
+	v, n, _ := bodyValue(a, a.MTU()-1)
+	if p, err := sa.Open(gatt.UUID16(hps.HTTPEntityBodyID), v); err != nil || string(p) != "secret" || n != 6 {
+		t.Errorf("a: got body %q, err: %v", p, err)
+	}
+
+	// A response for a central that disconnected is dropped
+	forgetCentral(b)
+	gateway.disconnect(b)
+	setResponse(b.id, &transaction{Response: errorResponse(http.StatusOK)})
+	if currentResponse(b) != nil {
+		t.Errorf("kept a response for a disconnected central")
+	}
+}
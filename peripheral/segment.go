@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+
+	"github.com/davidoram/bluetooth/hps"
+	"github.com/paypal/gatt"
+)
+
+// readCapacity is how many octets of a value fit in a read of cap octets,
+// once sealed for the central
+func readCapacity(c gatt.Central, cap int) int {
+	if links.session(c) != nil {
+		cap -= hps.SealOverhead
+	}
+	if cap < 0 {
+		return 0
+	}
+	return cap
+}
+
+// servedStatus is the status notified to the central, flagging the headers
+// or body truncated if they don't fit in a read. Reads are capped at the
+// MTU - 1, longer bodies are only served in segments.
+func servedStatus(t *transaction, c gatt.Central) hps.NotifyStatus {
+	ns := t.NotifyStatus
+	n := readCapacity(c, c.MTU()-1)
+	if len(t.Headers) > n {
+		ns.HeadersTruncated = true
+	}
+	if len(t.Body) > n {
+		ns.BodyTruncated = true
+	}
+	return ns
+}
+
+// segment returns up to n octets of the body from offset, it is empty past
+// the end
+func segment(body []byte, offset, n int) []byte {
+	if offset < 0 || offset >= len(body) || n <= 0 {
+		return []byte{}
+	}
+	end := offset + n
+	if end > len(body) {
+		end = len(body)
+	}
+	return body[offset:end]
+}
+
+// seekSegment sets the offset of the next body segment the central reads.
+// It is false if the central has no response.
+func seekSegment(c gatt.Central, offset int) bool {
+	responseMu.Lock()
+	defer responseMu.Unlock()
+	t := responses[c.ID()]
+	if t == nil {
+		return false
+	}
+	t.segment = offset
+	return true
+}
+
+// nextSegment returns up to n octets of the central's response body, from
+// its offset, and moves the offset past them. The transaction is nil if the
+// central has no response.
+func nextSegment(c gatt.Central, n int) ([]byte, *transaction) {
+	responseMu.Lock()
+	defer responseMu.Unlock()
+	t := responses[c.ID()]
+	if t == nil {
+		return nil, nil
+	}
+	b := segment(t.Body, t.segment, n)
+	t.segment += len(b)
+	return b, t
+}
+
+// addSegmentCharacteristic streams response bodies longer than a single
+// read. The central writes the offset to start from, then each read returns
+// the next segment.
+func addSegmentCharacteristic(s *gatt.Service) {
+	u := gatt.MustParseUUID(hps.BodySegmentID)
+	c := s.AddCharacteristic(u)
+	c.HandleWriteFunc(
+		func(r gatt.Request, data []byte) (status byte) {
+			data, err := links.open(r.Central, u, data)
+			if err != nil || len(data) != 4 {
+				log.Printf("Error: Write body segment offset %v", err)
+				return gatt.StatusUnexpectedError
+			}
+			if !seekSegment(r.Central, int(binary.LittleEndian.Uint32(data))) {
+				log.Printf("Warn: Write body segment offset from central_id: %s without a response", r.Central.ID())
+				return gatt.StatusUnexpectedError
+			}
+			return gatt.StatusSuccess
+		})
+	c.HandleReadFunc(
+		func(rsp gatt.ResponseWriter, req *gatt.ReadRequest) {
+			b, t := nextSegment(req.Central, readCapacity(req.Central, req.Cap))
+			if t == nil {
+				log.Printf("Warn: Read body segment from central_id: %s without a response", req.Central.ID())
+				return
+			}
+			if _, err := rsp.Write(links.seal(req.Central, u, b, req.Cap)); err != nil {
+				log.Printf("Error: Read body segment %v", err)
+				return
+			}
+			t.sentBody(len(b))
+		})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/davidoram/bluetooth/hps"
+)
+
+var segmentTests = []struct {
+	offset, n int
+	want      string
+}{
+	{0, 4, "hell"},
+	{4, 4, "o wo"},
+	{8, 4, "rld"},
+	{11, 4, ""},
+	{20, 4, ""},
+	{0, 0, ""},
+	{-1, 4, ""},
+}
+
+func TestSegment(t *testing.T) {
+	body := []byte("hello world")
+	for _, tt := range segmentTests {
+		if got := string(segment(body, tt.offset, tt.n)); got != tt.want {
+			t.Errorf("segment(%d, %d): got %q, want %q", tt.offset, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSegmentsPerCentral(t *testing.T) {
+	resetShutdown(t)
+	a, b := testCentral{id: "a"}, testCentral{id: "b"}
+	gateway.connect(a)
+	gateway.connect(b)
+	setResponse("a", &transaction{Response: &hps.Response{Body: []byte(strings.Repeat("a", 1000))}})
+	setResponse("b", &transaction{Response: &hps.Response{Body: []byte(strings.Repeat("b", 1000))}})
+
+	// Each central streams its own body, seeking as it goes, while the
+	// other does the same
+	var wg sync.WaitGroup
+	for _, c := range []testCentral{a, b} {
+		wg.Add(1)
+		go func(c testCentral) {
+			defer wg.Done()
+			var got []byte
+			for offset := 0; offset < 1000; offset += 100 {
+				if !seekSegment(c, offset) {
+					t.Errorf("%s: seek %d failed", c.id, offset)
+					return
+				}
+				for i := 0; i < 10; i++ {
+					s, _ := nextSegment(c, 10)
+					got = append(got, s...)
+				}
+			}
+			if want := strings.Repeat(c.id, 1000); string(got) != want {
+				t.Errorf("%s: got %q, want its own body", c.id, got)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if seekSegment(testCentral{id: "c"}, 0) {
+		t.Errorf("seek without a response: got true, want false")
+	}
+	if s, tx := nextSegment(testCentral{id: "c"}, 10); s != nil || tx != nil {
+		t.Errorf("read without a response: got %q, want nothing", s)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+var (
+	// shuttingDown is set once a signal is received, new requests are
+	// rejected from then on
+	shuttingDown int32
+
+	// upstreamCalls tracks the upstream calls in flight, shutdownMu orders
+	// adding to it with setting shuttingDown, so shutdown's Wait can't miss
+	// a call
+	upstreamCalls sync.WaitGroup
+	shutdownMu    sync.Mutex
+)
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// beginUpstream counts an upstream call in flight, call upstreamCalls.Done
+// once it completes. It is false once shutting down.
+func beginUpstream() bool {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if isShuttingDown() {
+		return false
+	}
+	upstreamCalls.Add(1)
+	return true
+}
+
+// awaitingCollection reports whether a central has still to be notified of
+// its response
+func awaitingCollection() bool {
+	responseMu.Lock()
+	defer responseMu.Unlock()
+	for _, t := range responses {
+		if !t.Notified {
+			return true
+		}
+	}
+	return false
+}
+
+// finishResponses logs the responses the centrals were notified of
+func finishResponses(now time.Time) {
+	responseMu.Lock()
+	ts := make([]*transaction, 0, len(responses))
+	for _, t := range responses {
+		ts = append(ts, t)
+	}
+	responseMu.Unlock()
+	for _, t := range ts {
+		t.finish(now)
+	}
+}
+
+// shutdown stops advertising, waits up to timeout for in-flight requests to
+// be answered, then disconnects the centrals and stops the adapter
+func shutdown(d gatt.Device, timeout time.Duration) {
+	shutdownMu.Lock()
+	atomic.StoreInt32(&shuttingDown, 1)
+	shutdownMu.Unlock()
+	sdNotify("STOPPING=1")
+	adv.stop()
+
+	deadline := time.Now().Add(timeout)
+	drained := make(chan struct{})
+	go func() {
+		upstreamCalls.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		// Give the central the chance to collect the last response
+		for awaitingCollection() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 100)
+		}
+	case <-time.After(time.Until(deadline)):
+		log.Printf("Warn: shutdown timeout, abandoning in-flight requests")
+	}
+
+	for _, c := range gateway.connectedCentrals() {
+		log.Printf("disconnecting central_id: %s", c.ID())
+		c.Close()
+	}
+	// Closing the connections re-enables advertising in the HCI layer, the
+	// disconnect handler stops it again for any closed later
+	adv.reassert()
+	finishResponses(time.Now())
+	if s, ok := d.(interface{ Stop() error }); ok {
+		if err := s.Stop(); err != nil {
+			log.Printf("Error: stop device %v", err)
+		}
+	}
+	log.Printf("shutdown complete")
+}
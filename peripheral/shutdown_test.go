@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidoram/bluetooth/hps"
+	"github.com/paypal/gatt"
+)
+
+// testDevice records the services, options & advertising of an adapter
+type testDevice struct {
+	gatt.Device
+	services    int
+	options     int
+	advertising bool
+	stopped     bool
+}
+
+func (d *testDevice) Option(o ...gatt.Option) error {
+	d.options++
+	return nil
+}
+
+func (d *testDevice) Advertise(a *gatt.AdvPacket) error {
+	d.advertising = true
+	return nil
+}
+
+func (d *testDevice) StopAdvertising() error {
+	d.advertising = false
+	return nil
+}
+
+func (d *testDevice) SetServices(ss []*gatt.Service) error {
+	d.services = len(ss)
+	return nil
+}
+
+func (d *testDevice) Stop() error {
+	d.stopped = true
+	return nil
+}
+
+// resetShutdown restores the state shutdown leaves behind, once the test
+// completes. The access log is returned, and "central" is connected.
+func resetShutdown(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	adv = newAdvertiser(advertisingConfig{Name: "gateway"})
+	accessLog = &accessLogger{w: &buf}
+	g := gateway
+	gateway = newGatewayState()
+	gateway.connect(testCentral{id: "central"})
+	t.Cleanup(func() {
+		gateway = g
+		atomic.StoreInt32(&shuttingDown, 0)
+		responseMu.Lock()
+		requests, responses = map[string]*savedRequest{}, map[string]*transaction{}
+		responseMu.Unlock()
+		adv, accessLog = nil, nil
+	})
+	return &buf
+}
+
+func TestShutdownWaitsForUpstream(t *testing.T) {
+	log := resetShutdown(t)
+	d := &testDevice{}
+
+	if !beginUpstream() {
+		t.Fatal("upstream call rejected before shutdown")
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		tx := &transaction{Response: errorResponse(http.StatusOK)}
+		tx.Notified = true
+		setResponse("central", tx)
+		upstreamCalls.Done()
+	}()
+
+	started := time.Now()
+	shutdown(d, time.Second*5)
+	if elapsed := time.Since(started); elapsed < time.Millisecond*50 || elapsed > time.Second*2 {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+	if !d.stopped {
+		t.Errorf("device not stopped")
+	}
+	if log.Len() == 0 {
+		t.Errorf("response not logged")
+	}
+	if beginUpstream() {
+		upstreamCalls.Done()
+		t.Errorf("upstream call accepted after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	resetShutdown(t)
+
+	// An upstream call that outlives the timeout
+	if !beginUpstream() {
+		t.Fatal("upstream call rejected before shutdown")
+	}
+	defer upstreamCalls.Done()
+
+	started := time.Now()
+	shutdown(&testDevice{}, time.Millisecond*100)
+	if elapsed := time.Since(started); elapsed < time.Millisecond*100 || elapsed > time.Second*2 {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+}
+
+func TestShutdownWaitsForCollection(t *testing.T) {
+	resetShutdown(t)
+
+	// The central hasn't been notified of the response
+	tx := &transaction{Response: errorResponse(http.StatusOK)}
+	setResponse("central", tx)
+	go func() {
+		time.Sleep(time.Millisecond * 150)
+		tx.setNotified()
+	}()
+
+	started := time.Now()
+	shutdown(&testDevice{}, time.Second*5)
+	if elapsed := time.Since(started); elapsed < time.Millisecond*150 || elapsed > time.Second*2 {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+}
+
+func TestStateChangedRecovers(t *testing.T) {
+	resetShutdown(t)
+	links = newSecureLinks(nil, false)
+	defer func() { links = nil }()
+	onStateChanged := stateChanged(deviceInfo(testDeviceInfo))
+	d := &testDevice{}
+
+	onStateChanged(d, gatt.StatePoweredOn)
+	if d.services != 2 || !d.advertising {
+		t.Fatalf("powered on: %d services, advertising %t", d.services, d.advertising)
+	}
+
+	// The adapter is reset
+	onStateChanged(d, gatt.StatePoweredOff)
+	if d.advertising {
+		t.Errorf("powered off: still advertising")
+	}
+	d.services = 0
+	onStateChanged(d, gatt.StatePoweredOn)
+	if d.services != 2 || !d.advertising {
+		t.Errorf("powered on again: %d services, advertising %t", d.services, d.advertising)
+	}
+	if s, _ := gateway.adapterState(); s != gatt.StatePoweredOn {
+		t.Errorf("got adapter state %s", s)
+	}
+
+	// No recovery once shutting down
+	onStateChanged(d, gatt.StatePoweredOff)
+	atomic.StoreInt32(&shuttingDown, 1)
+	d.services = 0
+	onStateChanged(d, gatt.StatePoweredOn)
+	if d.services != 0 || d.advertising {
+		t.Errorf("shutting down: %d services, advertising %t", d.services, d.advertising)
+	}
+}
+
+// readvertisingCentral re-enables advertising when closed, as the HCI layer does
+type readvertisingCentral struct {
+	testCentral
+	d *testDevice
+}
+
+func (c readvertisingCentral) Close() error {
+	c.d.advertising = true
+	return nil
+}
+
+func TestShutdownStopsAdvertisingAfterDisconnect(t *testing.T) {
+	resetShutdown(t)
+	d := &testDevice{}
+	adv.start(d, []gatt.UUID{gatt.MustParseUUID(hps.HpsServiceID)})
+	gateway.connect(readvertisingCentral{testCentral{id: "closing"}, d})
+
+	shutdown(d, time.Millisecond*100)
+	if d.advertising {
+		t.Errorf("advertising after shutdown")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+// stallTimeout is how long the notify loop may go without a heartbeat
+// before btserver reports itself unhealthy
+const stallTimeout = time.Second * 10
+
+// recoveryTimeout is how long the adapter may take to be powered on again,
+// after a reset or power off, before btserver reports itself unhealthy
+const recoveryTimeout = time.Minute
+
+// heartbeat records the last time a loop made progress
+type heartbeat struct {
+	nanos int64
+}
+
+func (h *heartbeat) beat() {
+	atomic.StoreInt64(&h.nanos, time.Now().UnixNano())
+}
+
+func (h *heartbeat) since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&h.nanos)))
+}
+
+var (
+	notifyHeartbeat heartbeat
+
+	// notifiers is the number of centrals subscribed to the status code
+	notifiers int32
+
+	readyOnce sync.Once
+)
+
+// sdNotify sends a state string to systemd, see sd_notify(3). It does
+// nothing unless btserver was started by systemd with a notify socket.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		// Abstract socket
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifyReady tells systemd the HPS service is registered & advertised, and
+// starts the watchdog
+func notifyReady() {
+	readyOnce.Do(func() {
+		if err := sdNotify("READY=1"); err != nil {
+			log.Printf("Error: sd_notify %v", err)
+		}
+		if interval := watchdogInterval(); interval > 0 {
+			go watchdog(interval)
+		}
+	})
+}
+
+// notifyStatus reports the number of connected centrals to systemd
+func notifyStatus() {
+	n := len(gateway.connectedCentrals())
+	if err := sdNotify(fmt.Sprintf("STATUS=%d centrals connected", n)); err != nil {
+		log.Printf("Error: sd_notify %v", err)
+	}
+}
+
+// watchdogInterval is half the watchdog timeout systemd expects pings
+// within, or zero if the watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog pings systemd while btserver is healthy. Once it stops, systemd
+// restarts the service.
+func watchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := healthy(); err != nil {
+			log.Printf("Error: unhealthy, skipping watchdog ping: %v", err)
+			sdNotify(fmt.Sprintf("STATUS=unhealthy: %v", err))
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Error: sd_notify %v", err)
+		}
+	}
+}
+
+// healthy checks that the adapter is powered on, or recovering from a reset,
+// that the last advertising command succeeded, and that notifications aren't
+// stuck in the HCI stack
+func healthy() error {
+	if isShuttingDown() {
+		return nil
+	}
+	if s, changed := gateway.adapterState(); s != gatt.StatePoweredOn {
+		if since := time.Since(changed); since > recoveryTimeout {
+			return fmt.Errorf("adapter state %s for %v", s.String(), since.Round(time.Second))
+		}
+		// stateChanged recovers once the adapter is powered on again
+		return nil
+	}
+	if err := adv.lastError(); err != nil {
+		return fmt.Errorf("advertising failed: %v", err)
+	}
+	if atomic.LoadInt32(&notifiers) > 0 && notifyHeartbeat.since() > stallTimeout {
+		return errors.New("status notifications stalled")
+	}
+	return nil
+}
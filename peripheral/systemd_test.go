@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+func TestHealthy(t *testing.T) {
+	defer func(g *gatewayState) { gateway = g }(gateway)
+	gateway = newGatewayState()
+
+	// adapter sets the adapter's state, changed ago
+	adapter := func(s gatt.State, ago time.Duration) {
+		gateway.setAdapter(s)
+		gateway.adapterChanged = time.Now().Add(-ago)
+	}
+
+	adapter(gatt.StatePoweredOn, time.Hour)
+	if err := healthy(); err != nil {
+		t.Errorf("powered on: %v", err)
+	}
+
+	// Recovering from a reset
+	adapter(gatt.StatePoweredOff, time.Second)
+	if err := healthy(); err != nil {
+		t.Errorf("powered off for a second: %v", err)
+	}
+	adapter(gatt.StateResetting, recoveryTimeout/2)
+	if err := healthy(); err != nil {
+		t.Errorf("resetting: %v", err)
+	}
+	adapter(gatt.StatePoweredOff, recoveryTimeout+time.Second)
+	if err := healthy(); err == nil {
+		t.Errorf("powered off past the recovery timeout: healthy")
+	}
+
+	// Never unhealthy while shutting down
+	atomic.StoreInt32(&shuttingDown, 1)
+	err := healthy()
+	atomic.StoreInt32(&shuttingDown, 0)
+	if err != nil {
+		t.Errorf("shutting down: %v", err)
+	}
+
+	// Stalled notifications
+	adapter(gatt.StatePoweredOn, time.Hour)
+	atomic.AddInt32(&notifiers, 1)
+	defer atomic.AddInt32(&notifiers, -1)
+	atomic.StoreInt64(&notifyHeartbeat.nanos, time.Now().Add(-2*stallTimeout).UnixNano())
+	if err := healthy(); err == nil {
+		t.Errorf("stalled notifications: healthy")
+	}
+	notifyHeartbeat.beat()
+	if err := healthy(); err != nil {
+		t.Errorf("notifying: %v", err)
+	}
+}
+
+func TestSetAdapterChanged(t *testing.T) {
+	g := newGatewayState()
+	g.setAdapter(gatt.StatePoweredOn)
+	_, changed := g.adapterState()
+	g.adapterChanged = changed.Add(-time.Hour)
+
+	// The same state again isn't a change
+	g.setAdapter(gatt.StatePoweredOn)
+	if _, got := g.adapterState(); !got.Equal(changed.Add(-time.Hour)) {
+		t.Errorf("changed moved on the same state")
+	}
+	g.setAdapter(gatt.StatePoweredOff)
+	if s, got := g.adapterState(); s != gatt.StatePoweredOff || time.Since(got) > time.Second {
+		t.Errorf("got %s changed %v", s, got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"invalid", "", 0},
+		{"0", "", 0},
+		{"-1", "", 0},
+		{"30000000", "", time.Second * 15},
+		{"30000000", pid, time.Second * 15},
+		{"30000000", "1", 0},
+	}
+	for _, tt := range tests {
+		setenv(t, "WATCHDOG_USEC", tt.usec)
+		setenv(t, "WATCHDOG_PID", tt.pid)
+		if got := watchdogInterval(); got != tt.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %v, want %v", tt.usec, tt.pid, got, tt.want)
+		}
+	}
+}
+
+// setenv sets an environment variable, or unsets it if empty, restoring it
+// once the test completes
+func setenv(t *testing.T, key, value string) {
+	prev, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+}